@@ -22,6 +22,11 @@ const callApi = async (path, options = {}) => {
   return response.text();
 };
 
+// projectPorts lists a project's configured ports and those found listening.
+export const projectPorts = (project) => [
+  ...new Set([...(project.ports || []), ...(project.listening_ports || [])]),
+];
+
 export const getHealth = async () => callApi('/health');
 
 export const getProjects = async () => callApi('/projects');
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidrocha/pi-manager/internal/api"
+	"github.com/davidrocha/pi-manager/internal/backup"
+	"github.com/davidrocha/pi-manager/internal/config"
+	"github.com/davidrocha/pi-manager/internal/logstore"
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// passphraseEnv holds the passphrase for the hooks' secrets, unless
+// --passphrase-file is given.
+const passphraseEnv = config.EnvPrefix + "BACKUP_PASSPHRASE"
+
+// offlineFlags are the flags of the backup and restore subcommands, which
+// open the state directly and so only work while the daemon is stopped.
+type offlineFlags struct {
+	fs             *flag.FlagSet
+	configPath     string
+	passphraseFile string
+	cli            config.Config
+}
+
+func newOfflineFlags(name, usage string) *offlineFlags {
+	f := &offlineFlags{fs: flag.NewFlagSet(name, flag.ExitOnError)}
+	def := config.Default()
+	f.fs.StringVar(&f.configPath, "config", "", "path to the YAML config file (default "+config.DefaultPath+" if it exists)")
+	f.fs.StringVar(&f.cli.State, "state", def.State, "path of the state file")
+	f.fs.StringVar(&f.cli.StateBackend, "state-backend", def.StateBackend, "how state is stored: json or bolt")
+	f.fs.StringVar(&f.passphraseFile, "passphrase-file", "", "file holding the passphrase for the hooks' secrets (default $"+passphraseEnv+")")
+	f.fs.Usage = func() {
+		fmt.Fprintf(f.fs.Output(), "usage: pi-manager %s\n", usage)
+		f.fs.PrintDefaults()
+	}
+	return f
+}
+
+// open loads the configured state. It fails while the daemon runs, which
+// holds the state's lock.
+func (f *offlineFlags) open() (*state.Store, error) {
+	cfg, err := loadConfig(f.fs, f.configPath, f.cli)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	store := newStore(cfg)
+	if err := store.Load(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("loading state: %w (stop the daemon, or use the API while it runs)", err)
+	}
+	store.SetHistoryLimit(cfg.HistoryPoints)
+	return store, nil
+}
+
+func (f *offlineFlags) passphrase() (string, error) {
+	if f.passphraseFile == "" {
+		return os.Getenv(passphraseEnv), nil
+	}
+	data, err := os.ReadFile(f.passphraseFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// runBackup writes an archive of the state to a file, or to stdout with
+// -o -.
+func runBackup(args []string) error {
+	f := newOfflineFlags("backup", "backup [flags]")
+	out := f.fs.String("o", "", "archive to write, - for stdout (default pi-manager-<host>-<time>.tar.gz)")
+	f.fs.Parse(args)
+	if f.fs.NArg() > 0 {
+		f.fs.Usage()
+		os.Exit(2)
+	}
+	passphrase, err := f.passphrase()
+	if err != nil {
+		return err
+	}
+	store, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	data, m, err := backup.Encode(store.Contents(), passphrase)
+	if err != nil {
+		return err
+	}
+	if *out == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	path := *out
+	if path == "" {
+		path = fmt.Sprintf("pi-manager-%s-%s.tar.gz", m.Hostname, m.CreatedAt.Format("20060102-150405"))
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wrote %s: %d projects, %d templates, %d hooks (secrets %s), %d runs, %d metric samples\n",
+		path, m.Counts.Projects, m.Counts.Templates, m.Counts.Hooks, m.Secrets, m.Counts.Runs, m.Counts.History)
+	return nil
+}
+
+// runRestore restores an archive into the state, or with --dry-run only
+// prints what restoring it would change.
+func runRestore(args []string) error {
+	f := newOfflineFlags("restore", "restore [flags] <archive|->")
+	mode := f.fs.String("mode", backup.Merge, "merge: add and update what the archive holds; replace: also remove what it does not hold")
+	dryRun := f.fs.Bool("dry-run", false, "only print what the restore would change")
+	f.fs.Parse(args)
+	if f.fs.NArg() != 1 {
+		f.fs.Usage()
+		os.Exit(2)
+	}
+	if *mode != backup.Merge && *mode != backup.Replace {
+		return errors.New("--mode must be merge or replace")
+	}
+	passphrase, err := f.passphrase()
+	if err != nil {
+		return err
+	}
+	var a backup.Archive
+	if name := f.fs.Arg(0); name == "-" {
+		a, err = backup.Read(os.Stdin, passphrase)
+	} else {
+		a, err = backup.ReadFile(name, passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	store, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	plan, contents := backup.NewPlan(store.Contents(), a, *mode, api.RestoreValidator{})
+	printPlan(os.Stdout, plan)
+	if *dryRun {
+		fmt.Println("dry run, nothing changed")
+		return nil
+	}
+	logs := logstore.New(filepath.Join(store.DataDir(), "logs"))
+	for _, id := range plan.Deleted() {
+		if err := api.RemoveArtifacts(store.DataDir(), id); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: removing artifacts of %s: %v\n", id, err)
+		}
+		if err := logs.RemoveProject(id); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: removing logs of %s: %v\n", id, err)
+		}
+	}
+	store.Restore(contents, *mode == backup.Replace)
+	if err := store.Snapshot(); err != nil {
+		return err
+	}
+	fmt.Println("restored")
+	return nil
+}
+
+func printPlan(w io.Writer, p backup.Plan) {
+	m := p.Manifest
+	fmt.Fprintf(w, "backup of %s taken %s, %s mode\n", m.Hostname, m.CreatedAt.Local().Format("2006-01-02 15:04:05"), p.Mode)
+	changes := func(kind string, cs []backup.Change) {
+		for _, c := range cs {
+			if c.Reason != "" {
+				fmt.Fprintf(w, "  %s %s: %s (%s)\n", kind, c.ID, c.Action, c.Reason)
+			} else {
+				fmt.Fprintf(w, "  %s %s: %s\n", kind, c.ID, c.Action)
+			}
+		}
+	}
+	changes("project", p.Projects)
+	changes("template", p.Templates)
+	changes("hook", p.Hooks)
+	fmt.Fprintf(w, "  %d runs and %d metric samples added\n", p.Runs, p.History)
+	for _, warn := range p.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", warn)
+	}
+}
@@ -3,46 +3,93 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/davidrocha/pi-manager/internal/api"
+	"github.com/davidrocha/pi-manager/internal/config"
 	"github.com/davidrocha/pi-manager/internal/state"
 	"github.com/davidrocha/pi-manager/internal/systemd"
 )
 
 func main() {
-	var addr string
-	var snapshotPath string
-	flag.StringVar(&addr, "addr", "127.0.0.1:8080", "bind address for HTTP server")
-	flag.StringVar(&snapshotPath, "state", "/var/lib/pi-manager/state.json", "path to persist state snapshots")
-	var allowActions bool
-	flag.BoolVar(&allowActions, "allow-actions", false, "allow API to execute configured project start commands (dangerous - default false)")
-	var fsBase string
-	home, _ := os.UserHomeDir()
-	if home == "" {
-		home = "/"
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backup":
+			if err := runBackup(os.Args[2:]); err != nil {
+				log.Fatalf("backup: %v", err)
+			}
+			return
+		case "restore":
+			if err := runRestore(os.Args[2:]); err != nil {
+				log.Fatalf("restore: %v", err)
+			}
+			return
+		}
 	}
-	flag.StringVar(&fsBase, "fs-base", home, "base path the file-browser API is allowed to access (default: home directory)")
+
+	def := config.Default()
+	configPath := flag.String("config", "", "path to the YAML config file (default "+config.DefaultPath+" if it exists)")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	var cli config.Config
+	flag.StringVar(&cli.Addr, "addr", def.Addr, "bind address for HTTP server")
+	flag.StringVar(&cli.State, "state", def.State, "path to persist state snapshots")
+	flag.StringVar(&cli.StateBackend, "state-backend", def.StateBackend, "how state is stored: json snapshots, or bolt for a database written on every change")
+	flag.BoolVar(&cli.AllowActions, "allow-actions", false, "allow API to execute configured project start commands (dangerous - default false)")
+	flag.BoolVar(&cli.RestoreRunning, "restore-running", false, "on startup, also restart projects that were running when the daemon stopped")
+	flag.BoolVar(&cli.AllowTerminal, "allow-terminal", false, "allow web terminal sessions in project directories (requires --allow-actions)")
+	flag.StringVar(&cli.FSBase, "fs-base", def.FSBase, "base path the file-browser API is allowed to access (default: home directory)")
+	flag.StringVar(&cli.ProjectsDir, "projects-dir", "", "directory of *.project.yaml project definitions to sync")
+	flag.Var((*rootList)(&cli.FSRoots), "fs-root", "additional directory the file-browser API may access, as path[:ro|:rw] (repeatable)")
 	flag.Parse()
 
+	// settings are re-read the same way on SIGHUP
+	load := func() (config.Config, error) {
+		return loadConfig(flag.CommandLine, *configPath, cli)
+	}
+	cfg, err := load()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+	if *printConfig {
+		out, err := cfg.YAML()
+		if err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		os.Stdout.Write(out)
+		return
+	}
+	opts, err := handlerOptions(cfg)
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+
 	log.Println("pi-manager starting")
 	startTime := time.Now()
 
-	store := state.NewStore(snapshotPath)
+	store := newStore(cfg)
 	if err := store.Load(); err != nil {
-		log.Printf("warning: failed to load snapshot: %v", err)
+		// starting empty would overwrite the projects on the next snapshot
+		log.Fatalf("loading state: %v (the file was left untouched)", err)
 	}
+	store.SetHistoryLimit(cfg.HistoryPoints)
 
 	sd := systemd.NewClient()
 
 	// start periodic snapshotter only (do not list system services)
+	var snapshotInterval atomic.Int64
+	snapshotInterval.Store(int64(cfg.SnapshotInterval.Duration))
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		ticker := time.NewTicker(30 * time.Second)
+		interval := time.Duration(snapshotInterval.Load())
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 		for {
 			select {
@@ -53,22 +100,51 @@ func main() {
 			if err := store.Snapshot(); err != nil {
 				log.Printf("snapshot error: %v", err)
 			}
+			if d := time.Duration(snapshotInterval.Load()); d != interval {
+				interval = d
+				ticker.Reset(d)
+			}
 		}
 	}()
 
 	// start HTTP server
-	h := api.NewHandler(store, sd, startTime, allowActions, fsBase)
-	srv := &http.Server{Addr: addr, Handler: h}
+	h := api.NewHandler(store, sd, startTime, opts)
+	srv := &http.Server{Addr: cfg.Addr, Handler: h}
 	go func() {
-		log.Printf("http server listening on %s", addr)
+		log.Printf("http server listening on %s", cfg.Addr)
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("http server failed: %v", err)
 		}
 	}()
 
+	// SIGHUP reloads everything but the listener and the state path;
+	// an invalid configuration is reported and the old one kept
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			var nextOpts api.Options
+			next, err := load()
+			if err == nil {
+				nextOpts, err = handlerOptions(next)
+			}
+			if err != nil {
+				log.Printf("reload: keeping current configuration: %v", err)
+				continue
+			}
+			if next.Addr != cfg.Addr || next.State != cfg.State || next.StateBackend != cfg.StateBackend {
+				log.Printf("reload: addr, state and state_backend only change on restart")
+			}
+			h.Reconfigure(nextOpts)
+			store.SetHistoryLimit(next.HistoryPoints)
+			snapshotInterval.Store(int64(next.SnapshotInterval.Duration))
+			log.Printf("configuration reloaded")
+		}
+	}()
+
 	// graceful shutdown
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	<-sig
 	log.Println("shutting down")
 	cancel()
@@ -78,5 +154,83 @@ func main() {
 	if err := store.Snapshot(); err != nil {
 		log.Printf("snapshot on exit failed: %v", err)
 	}
+	if err := store.Close(); err != nil {
+		log.Printf("closing state: %v", err)
+	}
 	log.Println("exited")
 }
+
+// loadConfig builds the configuration from the defaults, the config file,
+// PI_MANAGER_* environment variables and the flags given on the command
+// line, each overriding the previous ones.
+func loadConfig(fs *flag.FlagSet, path string, cli config.Config) (config.Config, error) {
+	cfg := config.Default()
+	optional := path == ""
+	if optional {
+		path = config.DefaultPath
+	}
+	if err := cfg.LoadFile(path, optional); err != nil {
+		return cfg, err
+	}
+	if err := cfg.ApplyEnv(); err != nil {
+		return cfg, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = cli.Addr
+		case "state":
+			cfg.State = cli.State
+		case "state-backend":
+			cfg.StateBackend = cli.StateBackend
+		case "allow-actions":
+			cfg.AllowActions = cli.AllowActions
+		case "restore-running":
+			cfg.RestoreRunning = cli.RestoreRunning
+		case "allow-terminal":
+			cfg.AllowTerminal = cli.AllowTerminal
+		case "fs-base":
+			cfg.FSBase = cli.FSBase
+		case "fs-root":
+			cfg.FSRoots = cli.FSRoots
+		case "projects-dir":
+			cfg.ProjectsDir = cli.ProjectsDir
+		}
+	})
+	return cfg, cfg.Validate()
+}
+
+// newStore returns the store of the configured backend, not yet loaded.
+func newStore(cfg config.Config) *state.Store {
+	if cfg.StateBackend == "bolt" {
+		return state.NewDBStore(cfg.State)
+	}
+	return state.NewStore(cfg.State)
+}
+
+func handlerOptions(cfg config.Config) (api.Options, error) {
+	jail, err := cfg.Jail()
+	if err != nil {
+		return api.Options{}, fmt.Errorf("file access roots: %w", err)
+	}
+	return api.Options{
+		AllowActions:   cfg.AllowActions,
+		AllowTerminal:  cfg.AllowTerminal,
+		RestoreRunning: cfg.RestoreRunning,
+		Jail:           jail,
+		HealthInterval: cfg.HealthInterval.Duration,
+		ProjectsDir:    cfg.ProjectsDir,
+	}, nil
+}
+
+// rootList collects repeated --fs-root flags.
+type rootList []string
+
+func (l *rootList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *rootList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
@@ -2,4 +2,13 @@ module github.com/davidrocha/pi-manager
 
 go 1.20
 
-require github.com/godbus/dbus/v5 v5.0.6
+require (
+	github.com/creack/pty v1.1.21
+	github.com/godbus/dbus/v5 v5.0.6
+	github.com/gorilla/websocket v1.5.3
+	go.etcd.io/bbolt v1.3.9
+	golang.org/x/crypto v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.26.0 // indirect
@@ -0,0 +1,308 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidrocha/pi-manager/internal/fsjail"
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+const (
+	defaultArtifactMaxSize = 100 << 20
+	defaultArtifactKeep    = 5
+)
+
+// projectArtifactDir is where the artifacts of a project's runs are
+// stored, below dataDir/artifacts. It reports false for ids such as "." or
+// ".." that do not name a directory of their own there.
+func projectArtifactDir(dataDir, project string) (string, bool) {
+	return childDir(filepath.Join(dataDir, "artifacts"), project)
+}
+
+// artifactDir is where the artifacts of a run are stored.
+func (h *Handler) artifactDir(project, run string) (string, bool) {
+	dir, ok := projectArtifactDir(h.store.DataDir(), project)
+	if !ok {
+		return "", false
+	}
+	return childDir(dir, run)
+}
+
+// childDir joins name onto dir, reporting false unless the result is a
+// direct child of dir.
+func childDir(dir, name string) (string, bool) {
+	p := filepath.Join(dir, name)
+	if strings.ContainsAny(name, `/\`) || filepath.Dir(p) != filepath.Clean(dir) {
+		return "", false
+	}
+	return p, true
+}
+
+// RemoveArtifacts deletes the artifacts of a project kept below dataDir.
+func RemoveArtifacts(dataDir, project string) error {
+	dir, ok := projectArtifactDir(dataDir, project)
+	if !ok {
+		return fmt.Errorf("invalid project id %q", project)
+	}
+	return os.RemoveAll(dir)
+}
+
+// collectArtifacts copies the files matched by the project's artifact
+// patterns into the run's artifact directory and records them on the run.
+// Files beyond the size cap are skipped with a note in the log.
+func (pr *pipelineRun) collectArtifacts() {
+	spec := pr.proj.Artifacts
+	if spec == nil || len(spec.Paths) == 0 || pr.proj.Path == "" {
+		return
+	}
+	limit := spec.MaxSize
+	if limit <= 0 {
+		limit = defaultArtifactMaxSize
+	}
+	pr.logf("===> Collecting artifacts\n")
+
+	files, err := matchArtifacts(pr.proj.Path, spec.Paths)
+	if err != nil {
+		pr.logf("ERROR collecting artifacts: %v\n", err)
+		return
+	}
+	dest, ok := pr.h.artifactDir(pr.proj.ID, pr.runID)
+	if !ok {
+		pr.logf("ERROR collecting artifacts: invalid project or run id\n")
+		return
+	}
+	var collected []state.Artifact
+	var total int64
+	for _, name := range files {
+		src := filepath.Join(pr.proj.Path, filepath.FromSlash(name))
+		info, err := os.Stat(src)
+		if err != nil {
+			continue
+		}
+		if total+info.Size() > limit {
+			pr.logf("Skipping %s: artifact size cap of %d bytes reached\n", name, limit)
+			continue
+		}
+		sum, err := copyArtifact(src, filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			pr.logf("ERROR copying %s: %v\n", name, err)
+			continue
+		}
+		total += info.Size()
+		collected = append(collected, state.Artifact{Name: name, Size: info.Size(), SHA256: sum})
+	}
+	pr.logf("Collected %d artifact(s), %d bytes\n\n", len(collected), total)
+	pr.h.store.UpdateRun(pr.proj.ID, pr.runID, func(r *state.Run) { r.Artifacts = collected })
+	pr.h.pruneArtifacts(pr.proj.ID, spec.Keep)
+}
+
+// matchArtifacts expands artifact patterns to regular files below root.
+// Matches resolving outside root (e.g. through symlinks) are ignored.
+func matchArtifacts(root string, patterns []string) ([]string, error) {
+	jail, err := fsjail.New(fsjail.Root{Path: root, Mode: fsjail.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var out []string
+	add := func(p string) {
+		real, err := jail.Resolve(p, false)
+		if err != nil {
+			return
+		}
+		info, err := os.Stat(real)
+		if err != nil || !info.Mode().IsRegular() {
+			return
+		}
+		rel, _ := filepath.Rel(root, p)
+		name := filepath.ToSlash(rel)
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	for _, pattern := range patterns {
+		pattern = filepath.FromSlash(strings.TrimSpace(pattern))
+		if filepath.IsAbs(pattern) || pattern == ".." || strings.HasPrefix(pattern, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("artifact pattern %q must be relative to the project path", pattern)
+		}
+		subtree := strings.HasSuffix(pattern, string(filepath.Separator)+"**")
+		pattern = strings.TrimSuffix(pattern, string(filepath.Separator)+"**")
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			info, err := os.Stat(m)
+			if err != nil {
+				continue
+			}
+			if !info.IsDir() {
+				add(m)
+				continue
+			}
+			if !subtree {
+				continue
+			}
+			filepath.WalkDir(m, func(p string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					add(p)
+				}
+				return nil
+			})
+		}
+	}
+	return out, nil
+}
+
+// validateArtifacts checks an artifact spec submitted through the API.
+func validateArtifacts(spec *state.ArtifactSpec) error {
+	if spec == nil {
+		return nil
+	}
+	for _, pattern := range spec.Paths {
+		p := filepath.FromSlash(strings.TrimSpace(pattern))
+		if p == "" || filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("pattern %q must be relative to the project path", pattern)
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	if spec.MaxSize < 0 || spec.Keep < 0 {
+		return fmt.Errorf("max_size and keep must not be negative")
+	}
+	return nil
+}
+
+// copyArtifact copies src to dst and returns the hex SHA-256 of the content.
+func copyArtifact(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), in); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// pruneArtifacts keeps the artifacts of the newest keep runs that have any
+// and deletes the rest, including directories of runs no longer recorded.
+func (h *Handler) pruneArtifacts(project string, keep int) {
+	if keep <= 0 {
+		keep = defaultArtifactKeep
+	}
+	retained := map[string]bool{}
+	for _, r := range h.store.GetRuns(project) {
+		if len(r.Artifacts) == 0 {
+			continue
+		}
+		if len(retained) < keep {
+			retained[r.ID] = true
+			continue
+		}
+		h.store.UpdateRun(project, r.ID, func(r *state.Run) { r.Artifacts = nil })
+	}
+	root, ok := projectArtifactDir(h.store.DataDir(), project)
+	if !ok {
+		return
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if dir, ok := childDir(root, e.Name()); ok && !retained[e.Name()] {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// handleRun serves run details and artifacts:
+//
+//	GET /api/v1/projects/{id}/runs/{run}
+//	GET /api/v1/projects/{id}/runs/{run}/artifacts            (?format=sha256sum for a checksum file)
+//	GET /api/v1/projects/{id}/runs/{run}/artifacts/{name...}
+func (h *Handler) handleRun(w http.ResponseWriter, r *http.Request, id, rest string) {
+	runID, sub, _ := strings.Cut(rest, "/")
+	run, ok := h.store.GetRun(id, runID)
+	if !ok {
+		h.wNotFound(w)
+		return
+	}
+	if sub == "" {
+		writeJSON(w, run)
+		return
+	}
+	if sub == "artifacts" {
+		if r.URL.Query().Get("format") == "sha256sum" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, a := range run.Artifacts {
+				fmt.Fprintf(w, "%s  %s\n", a.SHA256, a.Name)
+			}
+			return
+		}
+		artifacts := run.Artifacts
+		if artifacts == nil {
+			artifacts = []state.Artifact{}
+		}
+		writeJSON(w, artifacts)
+		return
+	}
+	name := strings.TrimPrefix(sub, "artifacts/")
+	if name == sub {
+		h.wNotFound(w)
+		return
+	}
+	// only names recorded on the run are served, so the path cannot be abused
+	for _, a := range run.Artifacts {
+		if a.Name != name {
+			continue
+		}
+		dir, ok := h.artifactDir(id, runID)
+		if !ok {
+			h.wNotFound(w)
+			return
+		}
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(a.Name)))
+		if err != nil {
+			h.wNotFound(w)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			writeJSON(w, map[string]string{"error": err.Error()})
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(a.Name)))
+		w.Header().Set("X-Checksum-Sha256", a.SHA256)
+		http.ServeContent(w, r, path.Base(a.Name), info.ModTime(), f)
+		return
+	}
+	h.wNotFound(w)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/davidrocha/pi-manager/internal/audit"
+	"github.com/davidrocha/pi-manager/internal/backup"
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// passphraseHeader carries the passphrase the hooks' secrets in a backup
+// are encrypted with.
+const passphraseHeader = "X-Backup-Passphrase"
+
+// maxBackupBody caps the size of an uploaded archive.
+const maxBackupBody = 64 << 20
+
+// handleBackup serves GET /api/v1/backup, an archive of the state. The
+// hooks' secrets are included, encrypted, when a passphrase is given; as
+// they are, taking a backup requires --allow-actions.
+func (h *Handler) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.options().AllowActions {
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, map[string]string{"error": "actions disabled"})
+		return
+	}
+	// encoded first, so a failure is an error response rather than a
+	// truncated archive
+	data, m, err := backup.Encode(h.store.Contents(), r.Header.Get(passphraseHeader))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	h.auditBackup(r, "backup.create", fmt.Sprintf("%d projects, secrets %s", m.Counts.Projects, m.Secrets))
+	host := m.Hostname
+	if host == "" {
+		host = "pi-manager"
+	}
+	name := fmt.Sprintf("pi-manager-%s-%s.tar.gz", host, m.CreatedAt.Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Write(data)
+}
+
+// handleRestore serves POST /api/v1/restore with an archive as the body.
+// ?mode=merge (default) adds and updates what the archive holds, replace
+// also removes the projects, templates and hooks it does not hold;
+// ?dry_run=true only returns the plan. Projects the restore would change
+// must be stopped first.
+func (h *Handler) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.options().AllowActions {
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, map[string]string{"error": "actions disabled"})
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = backup.Merge
+	}
+	if mode != backup.Merge && mode != backup.Replace {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "mode must be merge or replace"})
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	a, err := backup.Read(http.MaxBytesReader(w, r.Body, maxBackupBody), r.Header.Get(passphraseHeader))
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, backup.ErrNewerVersion) || errors.Is(err, state.ErrNewerVersion) {
+			status = http.StatusUnprocessableEntity
+		}
+		w.WriteHeader(status)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// the project sync must not change projects halfway through
+	h.sync.mu.Lock()
+	defer h.sync.mu.Unlock()
+	plan, contents := backup.NewPlan(h.store.Contents(), a, mode, RestoreValidator{})
+	if dryRun {
+		writeJSON(w, map[string]interface{}{"restored": false, "plan": plan})
+		return
+	}
+	running := []string{}
+	for _, id := range plan.Changed() {
+		if _, ok := h.activeTasks.Load(id); ok {
+			running = append(running, id)
+		}
+	}
+	if len(running) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		writeJSON(w, map[string]interface{}{"error": "stop the projects the restore changes first", "projects": running, "plan": plan})
+		return
+	}
+	for _, id := range plan.Deleted() {
+		h.deleteProject(id)
+	}
+	h.store.Restore(contents, mode == backup.Replace)
+	if err := h.store.Snapshot(); err != nil {
+		log.Printf("snapshot error: %v", err)
+	}
+	h.auditBackup(r, "backup.restore", fmt.Sprintf("%s from %s of %s", mode, a.Manifest.Hostname, a.Manifest.CreatedAt.Format("2006-01-02 15:04:05")))
+	writeJSON(w, map[string]interface{}{"restored": true, "plan": plan})
+}
+
+// RestoreValidator checks restored records like the API checks submitted
+// ones. A project directory that does not exist is not an error, as it may
+// yet be created on a new machine; the restore plan warns about it.
+type RestoreValidator struct{}
+
+// Project implements backup.Validator.
+func (RestoreValidator) Project(p state.ProjectConfig, templates map[string]state.Template, projects map[string]state.ProjectConfig) error {
+	lookup := func(id string) (state.Template, bool) {
+		t, ok := templates[id]
+		return t, ok
+	}
+	all := make(map[string]state.Project, len(projects))
+	for id, c := range projects {
+		all[id] = state.Project{ProjectConfig: c}
+	}
+	err := validateProjectWith(state.Project{ProjectConfig: p}, lookup, all)
+	var errs validationError
+	if !errors.As(err, &errs) {
+		return err
+	}
+	var kept validationError
+	for _, fe := range errs {
+		if fe.Field != "path" || fe.Message != errNoDirectory.Error() {
+			kept = append(kept, fe)
+		}
+	}
+	if len(kept) > 0 {
+		return kept
+	}
+	return nil
+}
+
+// Template implements backup.Validator.
+func (RestoreValidator) Template(t state.Template) error { return validateTemplate(t) }
+
+// Hook implements backup.Validator.
+func (RestoreValidator) Hook(hk state.Hook) error { return validateHook(hk) }
+
+func (h *Handler) auditBackup(r *http.Request, action, detail string) {
+	e := audit.Event{Action: action, Remote: r.RemoteAddr, Detail: detail}
+	if err := h.audit.Record(e); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
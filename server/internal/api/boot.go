@@ -0,0 +1,118 @@
+package api
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// bootTrigger is the run trigger of projects started when the daemon boots.
+const bootTrigger = "boot"
+
+// currentBootID identifies the running kernel boot, so a snapshot written
+// before a reboot can be told apart from one written before a daemon restart.
+func currentBootID() string {
+	b, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// reconcile corrects statuses loaded from the snapshot, which describe
+// processes of a previous daemon. Pipelines that were BOOTING can no longer
+// be running and are marked FAILED along with their runs. ACTIVE projects
+// are checked with check_cmd (with --allow-actions) or their ports;
+// without either they are kept only if the machine has not rebooted since.
+// Process groups the projects started are adopted, unless the machine
+// rebooted, so they can still be stopped. It returns the projects that were
+// running before and are not any more.
+func (h *Handler) reconcile() []string {
+	bootID := currentBootID()
+	rebooted := bootID == "" || bootID != h.store.BootID()
+	h.store.SetBootID(bootID)
+
+	var interrupted []string
+	for _, p := range h.store.GetProjects() {
+		if len(p.ProcessGroups) > 0 {
+			if rebooted {
+				h.procs.forget(p.ID)
+			} else {
+				h.procs.restore(p.ID, p.ProcessGroups)
+			}
+		}
+		switch p.Status {
+		case "BOOTING", "RUNNING":
+			h.store.UpdateRuntime(p.ID, func(p *state.ProjectRuntime) {
+				p.Status = "FAILED"
+				p.CurrentStep = ""
+				p.LastLog += "\nInterrupted: pi-manager was restarted.\n"
+			})
+			interrupted = append(interrupted, p.ID)
+		case "ACTIVE":
+			alive, known := probeProject(h.probed(p))
+			if alive || len(h.procs.list(p.ID)) > 0 || (!known && !rebooted) {
+				continue
+			}
+			h.store.UpdateRuntime(p.ID, func(p *state.ProjectRuntime) {
+				p.Status = "IDLE"
+				p.CurrentStep = ""
+				p.Progress = 0
+			})
+			interrupted = append(interrupted, p.ID)
+		default:
+			continue
+		}
+		log.Printf("reconcile: %s was %s, no longer running", p.ID, p.Status)
+	}
+	now := time.Now()
+	for _, p := range h.store.GetProjects() {
+		for _, r := range h.store.GetRuns(p.ID) {
+			if r.Status == "RUNNING" {
+				h.store.UpdateRun(p.ID, r.ID, func(r *state.Run) {
+					r.Status = "FAILED"
+					r.FinishedAt = &now
+				})
+			}
+		}
+	}
+	if err := h.store.Snapshot(); err != nil {
+		log.Printf("snapshot error: %v", err)
+	}
+	return interrupted
+}
+
+// autostart runs the boot sequence: projects with autostart, plus those in
+// restore, are started in dependency order, each after its autostart_delay.
+func (h *Handler) autostart(restore []string) {
+	want := map[string]bool{}
+	for _, id := range restore {
+		want[id] = true
+	}
+	for _, p := range h.store.GetProjects() {
+		if p.Autostart {
+			want[p.ID] = true
+		}
+	}
+	if len(want) == 0 {
+		return
+	}
+	if !h.options().AllowActions {
+		log.Printf("autostart: skipped %d project(s), actions are disabled", len(want))
+		return
+	}
+	ids := make([]string, 0, len(want))
+	for id := range want {
+		ids = append(ids, id)
+	}
+	order, err := dependencyOrder(h.projectMap(), ids)
+	if err != nil {
+		log.Printf("autostart: %v", err)
+		return
+	}
+	log.Printf("autostart: starting %s", strings.Join(order, ", "))
+	h.startOrdered(order, bootTrigger)
+}
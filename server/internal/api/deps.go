@@ -0,0 +1,352 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+const (
+	defaultHealthTimeout = 2 * time.Minute
+	healthPollInterval   = 2 * time.Second
+	checkCmdTimeout      = 10 * time.Second
+)
+
+// dependencyOrder returns ids together with everything they transitively
+// depend on, ordered so that dependencies come first. Unknown dependencies
+// and cycles are reported as errors.
+func dependencyOrder(projects map[string]state.Project, ids []string) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	mark := map[string]int{}
+	var order []string
+	var visit func(id string, path []string) error
+	visit = func(id string, path []string) error {
+		p, ok := projects[id]
+		if !ok {
+			if len(path) > 0 {
+				return fmt.Errorf("project %s depends on unknown project %s", path[len(path)-1], id)
+			}
+			return fmt.Errorf("unknown project %s", id)
+		}
+		switch mark[id] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(path, " -> "), id)
+		case visited:
+			return nil
+		}
+		mark[id] = visiting
+		deps := append([]string(nil), p.DependsOn...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(dep, append(path, id)); err != nil {
+				return err
+			}
+		}
+		mark[id] = visited
+		order = append(order, id)
+		return nil
+	}
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	for _, id := range sorted {
+		if err := visit(id, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// projectMap indexes the store's projects by ID.
+func (h *Handler) projectMap() map[string]state.Project {
+	m := map[string]state.Project{}
+	for _, p := range h.store.GetProjects() {
+		m[p.ID] = p
+	}
+	return m
+}
+
+// validateDependencies rejects a project whose depends_on would create a
+// cycle. Dependencies that do not exist yet are allowed.
+func (h *Handler) validateDependencies(p state.Project) error {
+	return checkDependencies(p, h.projectMap())
+}
+
+// checkDependencies is validateDependencies against the given projects,
+// which it modifies.
+func checkDependencies(p state.Project, projects map[string]state.Project) error {
+	projects[p.ID] = p
+	for _, dep := range p.DependsOn {
+		if dep == p.ID {
+			return fmt.Errorf("project cannot depend on itself")
+		}
+	}
+	// drop unknown ids so only cycles are reported
+	for id, q := range projects {
+		var known []string
+		for _, dep := range q.DependsOn {
+			if _, ok := projects[dep]; ok {
+				known = append(known, dep)
+			}
+		}
+		q.DependsOn = known
+		projects[id] = q
+	}
+	_, err := dependencyOrder(projects, []string{p.ID})
+	return err
+}
+
+// isUp reports whether a project is running or finished successfully.
+func (h *Handler) isUp(p state.Project) bool {
+	if _, running := h.activeTasks.Load(p.ID); running {
+		return true
+	}
+	return p.Status == "ACTIVE"
+}
+
+// isHealthy checks a project: its check_cmd must exit 0 if it has one;
+// otherwise a completed pipeline or an accepting port counts as healthy.
+func (h *Handler) isHealthy(p state.Project) bool {
+	p = h.probed(p)
+	if alive, known := probeProject(p); known && (alive || p.CheckCmd != "") {
+		return alive
+	}
+	return p.Status == "ACTIVE"
+}
+
+// probed returns p as it may be probed: check_cmd is a command like any
+// other, so without --allow-actions it is dropped and only the ports are
+// checked.
+func (h *Handler) probed(p state.Project) state.Project {
+	if !h.options().AllowActions {
+		p.CheckCmd = ""
+	}
+	return p
+}
+
+// probeProject looks for evidence that a project's service is running:
+// its check_cmd exiting 0, or one of its ports accepting connections.
+// known is false when the project has neither to check.
+func probeProject(p state.Project) (alive, known bool) {
+	if p.CheckCmd != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), checkCmdTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", p.CheckCmd)
+		cmd.Dir = p.Path
+		return cmd.Run() == nil, true
+	}
+	ports := p.AllPorts()
+	for _, port := range ports {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", port), time.Second)
+		if err == nil {
+			conn.Close()
+			return true, true
+		}
+	}
+	return false, len(ports) > 0
+}
+
+// waitHealthy polls a project until it is healthy, fails or timeout passes.
+func (h *Handler) waitHealthy(id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		p, ok := h.store.GetProject(id)
+		if !ok {
+			return errProjectNotFound
+		}
+		if h.isHealthy(p) {
+			return nil
+		}
+		if _, running := h.activeTasks.Load(id); !running && p.Status == "FAILED" {
+			return fmt.Errorf("%s failed", id)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s not healthy after %s", id, timeout)
+		}
+		time.Sleep(healthPollInterval)
+	}
+}
+
+// startOrdered starts the given projects and their dependencies in
+// dependency order, skipping projects that are already up. A project with
+// wait_healthy is only started once all of its dependencies are healthy;
+// if that fails it is marked FAILED and its dependents are not started.
+func (h *Handler) startOrdered(order []string, trigger string) {
+	blocked := map[string]bool{}
+	for _, id := range order {
+		p, ok := h.store.GetProject(id)
+		// a project already up is left alone, whatever its dependencies
+		if !ok || h.isUp(p) {
+			continue
+		}
+		if reason := dependencyBlocked(p, blocked); reason != "" {
+			blocked[id] = true
+			h.failStart(id, reason)
+			continue
+		}
+		if p.WaitHealthy {
+			timeout := defaultHealthTimeout
+			if p.HealthTimeout != "" {
+				timeout, _ = time.ParseDuration(p.HealthTimeout)
+			}
+			for _, dep := range p.DependsOn {
+				if err := h.waitHealthy(dep, timeout); err != nil {
+					blocked[id] = true
+					h.failStart(id, "dependency "+err.Error())
+					break
+				}
+			}
+			if blocked[id] {
+				continue
+			}
+		}
+		if trigger == bootTrigger && p.AutostartDelay != "" {
+			if d, err := time.ParseDuration(p.AutostartDelay); err == nil {
+				time.Sleep(d)
+			}
+		}
+		if _, err := h.startProject(id, runOptions{Trigger: trigger}); err != nil && err != errAlreadyRunning {
+			blocked[id] = true
+			log.Printf("start %s: %v", id, err)
+		}
+	}
+}
+
+func dependencyBlocked(p state.Project, blocked map[string]bool) string {
+	for _, dep := range p.DependsOn {
+		if blocked[dep] {
+			return "dependency " + dep + " could not be started"
+		}
+	}
+	return ""
+}
+
+// failStart records on a project why it was not started.
+func (h *Handler) failStart(id, reason string) {
+	log.Printf("start %s: %s", id, reason)
+	h.store.UpdateRuntime(id, func(p *state.ProjectRuntime) {
+		p.Status = "FAILED"
+		p.CurrentStep = ""
+		p.LastLog = "Not started: " + reason + "\n"
+	})
+}
+
+// stopProject stops a project's pipeline and marks it idle.
+func (h *Handler) stopProject(id string) error {
+	mu := h.opLock(id)
+	mu.Lock()
+	defer mu.Unlock()
+	return h.stopProjectLocked(id)
+}
+
+// stopProjectLocked is stopProject for callers holding the project's opLock.
+func (h *Handler) stopProjectLocked(id string) error {
+	if _, ok := h.store.GetProject(id); !ok {
+		return errProjectNotFound
+	}
+	h.killProject(id)
+	h.store.UpdateRuntime(id, func(p *state.ProjectRuntime) {
+		p.Status = "IDLE"
+		p.Progress = 0
+		p.CurrentStep = ""
+	})
+	return nil
+}
+
+// groupMembers returns the IDs of projects in a group.
+func (h *Handler) groupMembers(group string) []string {
+	var ids []string
+	for _, p := range h.store.GetProjects() {
+		if p.Group == group {
+			ids = append(ids, p.ID)
+		}
+	}
+	return ids
+}
+
+// handleGroups lists project groups with their members in start order.
+func (h *Handler) handleGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	members := map[string][]string{}
+	for _, p := range h.store.GetProjects() {
+		if p.Group != "" {
+			members[p.Group] = append(members[p.Group], p.ID)
+		}
+	}
+	projects := h.projectMap()
+	out := make([]map[string]interface{}, 0, len(members))
+	for name, ids := range members {
+		order, err := dependencyOrder(projects, ids)
+		entry := map[string]interface{}{"name": name, "projects": ids}
+		if err != nil {
+			entry["error"] = err.Error()
+		} else {
+			entry["start_order"] = order
+		}
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["name"].(string) < out[j]["name"].(string) })
+	writeJSON(w, out)
+}
+
+// handleGroupAction handles POST /api/v1/groups/{name}/start and /stop.
+// Start brings members (and their dependencies) up in dependency order in
+// the background; stop takes members down in reverse order.
+func (h *Handler) handleGroupAction(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/groups/"), "/")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ids := h.groupMembers(name)
+	if len(ids) == 0 {
+		h.wNotFound(w)
+		return
+	}
+	order, err := dependencyOrder(h.projectMap(), ids)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	switch action {
+	case "start":
+		if !h.options().AllowActions {
+			w.WriteHeader(http.StatusForbidden)
+			writeJSON(w, map[string]string{"error": "actions disabled"})
+			return
+		}
+		go h.startOrdered(order, "group:"+name)
+		writeJSON(w, map[string]interface{}{"status": "starting", "order": order})
+	case "stop":
+		members := map[string]bool{}
+		for _, id := range ids {
+			members[id] = true
+		}
+		var stopped []string
+		for i := len(order) - 1; i >= 0; i-- {
+			if members[order[i]] {
+				h.stopProject(order[i])
+				stopped = append(stopped, order[i])
+			}
+		}
+		writeJSON(w, map[string]interface{}{"status": "stopped", "order": stopped})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "unknown action"})
+	}
+}
@@ -0,0 +1,537 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/audit"
+	"github.com/davidrocha/pi-manager/internal/fsjail"
+)
+
+const (
+	defaultReadLimit = 256 << 10 // bytes returned by /fs/read
+	maxReadLimit     = 4 << 20
+	maxWriteSize     = 8 << 20   // bytes accepted by /fs/write
+	maxUploadSize    = 512 << 20 // bytes accepted by one /fs/upload request
+)
+
+// fsEntry describes a file or directory in listings.
+type fsEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"` // relative to the default root, or absolute in other roots
+	AbsPath string    `json:"abs_path"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"` // e.g. -rw-r--r--
+	ModTime time.Time `json:"mtime"`
+	Symlink bool      `json:"symlink,omitempty"`
+}
+
+// fsError writes the response for a failed filesystem operation.
+func fsError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, fsjail.ErrOutside), errors.Is(err, fsjail.ErrReadOnly), errors.Is(err, os.ErrPermission):
+		status = http.StatusForbidden
+	case errors.Is(err, os.ErrNotExist):
+		status = http.StatusNotFound
+	case errors.Is(err, os.ErrExist):
+		status = http.StatusConflict
+	}
+	msg := err.Error()
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		msg = pe.Err.Error() // do not echo absolute paths
+	}
+	w.WriteHeader(status)
+	writeJSON(w, map[string]string{"error": msg})
+}
+
+// handleFS lists directories/files under the server-configured roots.
+// Query params: ?path=relative/path (optional, relative to the default
+// root; absolute paths select other roots); ?all=true also lists files and
+// hidden entries. Response: {current_path, entries: [fsEntry]}
+func (h *Handler) handleFS(w http.ResponseWriter, r *http.Request) {
+	jail := h.options().Jail
+	tgt, err := jail.Resolve(r.URL.Query().Get("path"), false)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	info, err := os.Stat(tgt)
+	if err != nil || !info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]string{"error": "not found or not a directory"})
+		return
+	}
+	entries, err := os.ReadDir(tgt)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	all := r.URL.Query().Get("all") == "true"
+	out := make([]fsEntry, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if !all {
+			// Only show directories, and hide dot-folders and specific
+			// noise folders
+			if !e.IsDir() || strings.HasPrefix(name, ".") ||
+				name == "go" ||
+				name == "snap" ||
+				name == "node_modules" {
+				continue
+			}
+		}
+
+		full := filepath.Join(tgt, name)
+		entry := fsEntry{Name: name, Path: jail.Rel(full), AbsPath: full, IsDir: e.IsDir()}
+		if e.Type()&os.ModeSymlink != 0 {
+			entry.Symlink = true
+		}
+		// describe what symlinks point to
+		if fi, err := os.Stat(full); err == nil {
+			entry.IsDir = fi.IsDir()
+			entry.Size = fi.Size()
+			entry.Mode = fi.Mode().String()
+			entry.ModTime = fi.ModTime()
+		}
+		out = append(out, entry)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].IsDir && !out[j].IsDir })
+	writeJSON(w, map[string]interface{}{
+		"current_path": tgt,
+		"entries":      out,
+	})
+}
+
+// handleFSAction serves the file manager below /api/v1/fs/:
+//
+//	GET  roots                      the accessible roots and their modes
+//	GET  read?path=&offset=&limit=  part of a text file
+//	GET  download?path=             a file, with HTTP range support
+//	POST upload?path=dir            multipart files into a directory (?overwrite=true)
+//	PUT  write?path=                replace a file's content (?if_mtime= guards against lost updates)
+//	POST mkdir {"path"}
+//	POST rename {"from", "to"}
+//	POST delete {"path", "recursive"}
+//
+// Reading and downloading files require --allow-actions; changes also
+// require a writable root, and are recorded in the audit log.
+func (h *Handler) handleFSAction(w http.ResponseWriter, r *http.Request) {
+	jail := h.options().Jail
+	action := strings.TrimPrefix(r.URL.Path, "/api/v1/fs/")
+	switch action {
+	case "roots", "read", "download":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if action == "roots" {
+			writeJSON(w, jail.Roots())
+			return
+		}
+		// file contents may hold secrets, unlike listings
+		if !h.options().AllowActions {
+			w.WriteHeader(http.StatusForbidden)
+			writeJSON(w, map[string]string{"error": "actions disabled"})
+			return
+		}
+		if action == "read" {
+			h.fsRead(w, r)
+		} else {
+			h.fsDownload(w, r)
+		}
+		return
+	case "upload", "write", "mkdir", "rename", "delete":
+	default:
+		h.wNotFound(w)
+		return
+	}
+	want := http.MethodPost
+	if action == "write" {
+		want = http.MethodPut
+	}
+	if r.Method != want {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.options().AllowActions {
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, map[string]string{"error": "actions disabled"})
+		return
+	}
+	switch action {
+	case "upload":
+		h.fsUpload(w, r)
+	case "write":
+		h.fsWrite(w, r)
+	case "mkdir":
+		h.fsMkdir(w, r)
+	case "rename":
+		h.fsRename(w, r)
+	case "delete":
+		h.fsDelete(w, r)
+	}
+}
+
+func (h *Handler) auditFS(r *http.Request, action, path, detail string) {
+	e := audit.Event{Action: action, Remote: r.RemoteAddr, Path: path, Detail: detail}
+	if err := h.audit.Record(e); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+func (h *Handler) fsRead(w http.ResponseWriter, r *http.Request) {
+	jail := h.options().Jail
+	q := r.URL.Query()
+	tgt, err := jail.Resolve(q.Get("path"), false)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	offset, _ := strconv.ParseInt(q.Get("offset"), 10, 64)
+	limit := int64(defaultReadLimit)
+	if v, err := strconv.ParseInt(q.Get("limit"), 10, 64); err == nil && v > 0 {
+		limit = v
+	}
+	if limit > maxReadLimit {
+		limit = maxReadLimit
+	}
+	if offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "invalid offset"})
+		return
+	}
+	f, err := os.Open(tgt)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	if info.IsDir() {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "is a directory"})
+		return
+	}
+	buf := make([]byte, limit)
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		fsError(w, err)
+		return
+	}
+	buf = buf[:n]
+	if bytes.IndexByte(buf, 0) >= 0 {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		writeJSON(w, map[string]string{"error": "not a text file; use download"})
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"path":        jail.Rel(tgt),
+		"size":        info.Size(),
+		"mode":        info.Mode().String(),
+		"mtime":       info.ModTime(),
+		"offset":      offset,
+		"next_offset": offset + int64(n),
+		"eof":         offset+int64(n) >= info.Size(),
+		"data":        string(buf),
+	})
+}
+
+func (h *Handler) fsDownload(w http.ResponseWriter, r *http.Request) {
+	jail := h.options().Jail
+	tgt, err := jail.Resolve(r.URL.Query().Get("path"), false)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	f, err := os.Open(tgt)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	if info.IsDir() {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "is a directory"})
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.Name()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// writeFileAtomic replaces path with the content of rd through a temporary
+// file in the same directory, keeping the mode of an existing file.
+func writeFileAtomic(path string, rd io.Reader, mode os.FileMode) (int64, error) {
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			return 0, fmt.Errorf("%s: %w", filepath.Base(path), errIsDir)
+		}
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, rd)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+var errIsDir = errors.New("is a directory")
+
+func (h *Handler) fsWrite(w http.ResponseWriter, r *http.Request) {
+	jail := h.options().Jail
+	q := r.URL.Query()
+	tgt, err := jail.Resolve(q.Get("path"), true)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	if v := q.Get("if_mtime"); v != "" {
+		want, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid if_mtime"})
+			return
+		}
+		if info, err := os.Stat(tgt); err == nil && !info.ModTime().Equal(want) {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]interface{}{"error": "file changed since it was read", "mtime": info.ModTime()})
+			return
+		}
+	}
+	n, err := writeFileAtomic(tgt, http.MaxBytesReader(w, r.Body, maxWriteSize), 0o644)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			writeJSON(w, map[string]string{"error": "file too large to edit"})
+			return
+		}
+		if errors.Is(err, errIsDir) {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "is a directory"})
+			return
+		}
+		fsError(w, err)
+		return
+	}
+	h.auditFS(r, "fs.write", tgt, fmt.Sprintf("%d bytes", n))
+	info, _ := os.Stat(tgt)
+	writeJSON(w, map[string]interface{}{"path": jail.Rel(tgt), "size": n, "mtime": info.ModTime()})
+}
+
+func (h *Handler) fsUpload(w http.ResponseWriter, r *http.Request) {
+	jail := h.options().Jail
+	dir, err := jail.Resolve(r.URL.Query().Get("path"), true)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]string{"error": "not found or not a directory"})
+		return
+	}
+	overwrite := r.URL.Query().Get("overwrite") == "true"
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "expected multipart/form-data"})
+		return
+	}
+	var saved []fsEntry
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]interface{}{"error": "upload failed", "saved": saved})
+			return
+		}
+		name := part.FileName()
+		if name == "" {
+			continue // not a file field
+		}
+		name = filepath.Base(filepath.Clean("/" + name))
+		if name == "/" || name == "." {
+			continue
+		}
+		// an existing entry may be a symlink leading out of the roots
+		tgt, err := jail.Resolve(filepath.Join(dir, name), true)
+		if err != nil {
+			fsError(w, err)
+			return
+		}
+		if _, err := os.Lstat(tgt); err == nil && !overwrite {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]interface{}{"error": name + " already exists", "saved": saved})
+			return
+		}
+		n, err := writeFileAtomic(tgt, part, 0o644)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				writeJSON(w, map[string]interface{}{"error": "upload too large", "saved": saved})
+				return
+			}
+			fsError(w, err)
+			return
+		}
+		h.auditFS(r, "fs.upload", tgt, fmt.Sprintf("%d bytes", n))
+		entry := fsEntry{Name: name, Path: jail.Rel(tgt), AbsPath: tgt, Size: n}
+		if info, err := os.Stat(tgt); err == nil {
+			entry.Mode = info.Mode().String()
+			entry.ModTime = info.ModTime()
+		}
+		saved = append(saved, entry)
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]interface{}{"saved": saved})
+}
+
+func (h *Handler) fsMkdir(w http.ResponseWriter, r *http.Request) {
+	jail := h.options().Jail
+	var body struct {
+		Path string `json:"path"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Path == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "path required"})
+		return
+	}
+	tgt, err := jail.Resolve(body.Path, true)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	if err := os.MkdirAll(tgt, 0o755); err != nil {
+		fsError(w, err)
+		return
+	}
+	h.auditFS(r, "fs.mkdir", tgt, "")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]string{"path": jail.Rel(tgt)})
+}
+
+func (h *Handler) fsRename(w http.ResponseWriter, r *http.Request) {
+	jail := h.options().Jail
+	var body struct {
+		From      string `json:"from"`
+		To        string `json:"to"`
+		Overwrite bool   `json:"overwrite"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.From == "" || body.To == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "from and to required"})
+		return
+	}
+	// a symlink is renamed itself, not its target
+	from, err := jail.ResolveLink(body.From, true)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	to, err := jail.ResolveLink(body.To, true)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	if _, err := os.Lstat(from); err != nil {
+		fsError(w, err)
+		return
+	}
+	if _, err := os.Lstat(to); err == nil && !body.Overwrite {
+		w.WriteHeader(http.StatusConflict)
+		writeJSON(w, map[string]string{"error": "destination exists"})
+		return
+	}
+	if err := os.Rename(from, to); err != nil {
+		fsError(w, err)
+		return
+	}
+	h.auditFS(r, "fs.rename", from, "to "+to)
+	writeJSON(w, map[string]string{"path": jail.Rel(to)})
+}
+
+func (h *Handler) fsDelete(w http.ResponseWriter, r *http.Request) {
+	jail := h.options().Jail
+	var body struct {
+		Path      string `json:"path"`
+		Recursive bool   `json:"recursive"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Path == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "path required"})
+		return
+	}
+	// a symlink is deleted itself, not its target
+	tgt, err := jail.ResolveLink(body.Path, true)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	info, err := os.Lstat(tgt)
+	if err != nil {
+		fsError(w, err)
+		return
+	}
+	if info.IsDir() && body.Recursive {
+		err = os.RemoveAll(tgt)
+	} else {
+		err = os.Remove(tgt) // fails for non-empty directories
+	}
+	if err != nil {
+		if info.IsDir() && !body.Recursive {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]string{"error": "directory not empty; set recursive"})
+			return
+		}
+		fsError(w, err)
+		return
+	}
+	detail := ""
+	if info.IsDir() && body.Recursive {
+		detail = "recursive"
+	}
+	h.auditFS(r, "fs.delete", tgt, detail)
+	writeJSON(w, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/git"
+)
+
+// handleProjectGit reports the git state of a project's working copy.
+// Query param: ?fetch=true refreshes remote refs first so "behind" is current.
+func (h *Handler) handleProjectGit(w http.ResponseWriter, r *http.Request, id string) {
+	p, ok := h.store.GetProject(id)
+	if !ok {
+		h.wNotFound(w)
+		return
+	}
+	if p.Path == "" {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]string{"error": "project has no path"})
+		return
+	}
+	if r.URL.Query().Get("fetch") == "true" {
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+		if err := git.Fetch(ctx, p.Path, nil); err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			writeJSON(w, map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	st, err := git.GetStatus(p.Path)
+	if err == git.ErrNotRepository {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"repo":   p.Repo,
+		"branch": p.Branch,
+		"status": st,
+	})
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// maxHookBody caps the size of webhook payloads we are willing to verify.
+const maxHookBody = 1 << 20
+
+// handleHooks lists (GET) and creates (POST) webhooks. Because a hook can run
+// a pipeline, managing hooks requires --allow-actions; secrets are only
+// returned once, when the hook is created.
+func (h *Handler) handleHooks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		hooks := h.store.GetHooks()
+		for i := range hooks {
+			hooks[i].Secret = ""
+		}
+		writeJSON(w, hooks)
+	case http.MethodPost:
+		if !h.options().AllowActions {
+			w.WriteHeader(http.StatusForbidden)
+			writeJSON(w, map[string]string{"error": "actions disabled"})
+			return
+		}
+		var hk state.Hook
+		if err := json.NewDecoder(r.Body).Decode(&hk); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid json"})
+			return
+		}
+		if hk.Action == "" {
+			hk.Action = "deploy"
+		}
+		if err := validateHook(hk); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": err.Error()})
+			return
+		}
+		if _, ok := h.store.GetProject(hk.Project); !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "unknown project"})
+			return
+		}
+		if _, exists := h.store.GetHook(hk.ID); exists {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]string{"error": "hook already exists"})
+			return
+		}
+		if hk.Secret == "" {
+			buf := make([]byte, 32)
+			if _, err := rand.Read(buf); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				writeJSON(w, map[string]string{"error": err.Error()})
+				return
+			}
+			hk.Secret = hex.EncodeToString(buf)
+		}
+		h.store.AddHook(hk)
+		if err := h.store.Snapshot(); err != nil {
+			log.Printf("snapshot error: %v", err)
+		}
+		writeJSON(w, hk)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// validateHook checks a hook's id, action and branch patterns.
+func validateHook(hk state.Hook) error {
+	if hk.ID == "" || strings.Contains(hk.ID, "/") {
+		return errors.New("valid id required")
+	}
+	if hk.Action != "start" && hk.Action != "deploy" {
+		return errors.New(`action must be "start" or "deploy"`)
+	}
+	for _, b := range hk.Branches {
+		if _, err := path.Match(b, ""); err != nil {
+			return errors.New("invalid branch pattern " + b)
+		}
+	}
+	return nil
+}
+
+// handleHook receives a webhook delivery (POST) or manages a single hook
+// (GET/DELETE). Deliveries are authenticated by their HMAC signature alone.
+func (h *Handler) handleHook(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/hooks/")
+	if id == "" {
+		h.handleHooks(w, r)
+		return
+	}
+	hk, ok := h.store.GetHook(id)
+	if !ok {
+		h.wNotFound(w)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		hk.Secret = ""
+		writeJSON(w, hk)
+	case http.MethodDelete:
+		if !h.options().AllowActions {
+			w.WriteHeader(http.StatusForbidden)
+			writeJSON(w, map[string]string{"error": "actions disabled"})
+			return
+		}
+		h.store.RemoveHook(id)
+		if err := h.store.Snapshot(); err != nil {
+			log.Printf("snapshot error: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		h.deliverHook(w, r, hk)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) deliverHook(w http.ResponseWriter, r *http.Request, hk state.Hook) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBody))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		writeJSON(w, map[string]string{"error": "payload too large"})
+		return
+	}
+	if !verifySignature(r.Header, body, hk.Secret) {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]string{"error": "invalid signature"})
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	if event == "" {
+		event = r.Header.Get("X-Gitea-Event")
+	}
+	if event == "" {
+		event = r.Header.Get("X-Gogs-Event")
+	}
+	if event == "ping" {
+		writeJSON(w, map[string]string{"status": "pong"})
+		return
+	}
+	if event != "" && event != "push" {
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, map[string]string{"status": "ignored", "reason": "event " + event})
+		return
+	}
+
+	var push struct {
+		Ref     string `json:"ref"`
+		After   string `json:"after"`
+		Deleted bool   `json:"deleted"`
+	}
+	if err := json.Unmarshal(body, &push); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "invalid json"})
+		return
+	}
+	// a branch deletion arrives as a push with an all-zero "after" commit
+	if push.Deleted || (push.After != "" && strings.Trim(push.After, "0") == "") {
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, map[string]string{"status": "ignored", "reason": "ref deleted"})
+		return
+	}
+
+	p, ok := h.store.GetProject(hk.Project)
+	if !ok {
+		h.wNotFound(w)
+		return
+	}
+	ref := strings.TrimPrefix(strings.TrimPrefix(push.Ref, "refs/heads/"), "refs/tags/")
+	if !refAllowed(hk, p, ref) {
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, map[string]string{"status": "ignored", "reason": "ref " + ref + " filtered"})
+		return
+	}
+
+	opts := runOptions{Trigger: "hook:" + hk.ID}
+	if hk.Action == "deploy" {
+		opts.Deploy = true
+		opts.Ref = ref
+	}
+	runID, err := h.startProject(p.ID, opts)
+	switch err {
+	case nil:
+		log.Printf("hook %s: %s %s at %s", hk.ID, hk.Action, p.ID, ref)
+		writeJSON(w, map[string]string{"status": "started", "run": runID})
+	case errAlreadyRunning:
+		w.WriteHeader(http.StatusConflict)
+		writeJSON(w, map[string]string{"error": "project already running"})
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, map[string]string{"error": err.Error()})
+	}
+}
+
+// verifySignature checks the HMAC-SHA256 signature of a delivery. GitHub
+// sends "X-Hub-Signature-256: sha256=<hex>"; Gitea and Gogs send the bare
+// hex digest in X-Gitea-Signature / X-Gogs-Signature.
+func verifySignature(hdr http.Header, body []byte, secret string) bool {
+	if secret == "" {
+		return false
+	}
+	sig := strings.TrimPrefix(hdr.Get("X-Hub-Signature-256"), "sha256=")
+	if sig == "" {
+		sig = hdr.Get("X-Gitea-Signature")
+	}
+	if sig == "" {
+		sig = hdr.Get("X-Gogs-Signature")
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil || len(got) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// refAllowed applies the hook's branch filters. Without filters only pushes to
+// the project's configured branch (or any branch, if it has none) qualify.
+func refAllowed(hk state.Hook, p state.Project, ref string) bool {
+	if ref == "" {
+		return false
+	}
+	if len(hk.Branches) == 0 {
+		return p.Branch == "" || p.Branch == ref
+	}
+	for _, pattern := range hk.Branches {
+		if ok, _ := path.Match(pattern, ref); ok {
+			return true
+		}
+	}
+	return false
+}
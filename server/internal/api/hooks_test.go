@@ -0,0 +1,47 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestVerifySignature(t *testing.T) {
+	const secret = "s3cret"
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		body   string
+		secret string
+		want   bool
+	}{
+		{"github", map[string]string{"X-Hub-Signature-256": "sha256=" + sig}, string(body), secret, true},
+		{"gitea", map[string]string{"X-Gitea-Signature": sig}, string(body), secret, true},
+		{"gogs", map[string]string{"X-Gogs-Signature": sig}, string(body), secret, true},
+		{"tampered body", map[string]string{"X-Hub-Signature-256": "sha256=" + sig}, `{"ref":"refs/heads/evil"}`, secret, false},
+		{"wrong secret", map[string]string{"X-Gitea-Signature": sig}, string(body), "other", false},
+		{"missing header", nil, string(body), secret, false},
+		{"empty signature", map[string]string{"X-Hub-Signature-256": "sha256="}, string(body), secret, false},
+		{"not hex", map[string]string{"X-Gitea-Signature": "zz"}, string(body), secret, false},
+		{"truncated", map[string]string{"X-Gitea-Signature": sig[:32]}, string(body), secret, false},
+		{"no secret", map[string]string{"X-Gitea-Signature": sig}, string(body), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hdr := http.Header{}
+			for k, v := range tt.header {
+				hdr.Set(k, v)
+			}
+			if got := verifySignature(hdr, []byte(tt.body), tt.secret); got != tt.want {
+				t.Errorf("verifySignature = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/logstore"
+	"github.com/davidrocha/pi-manager/internal/systemd"
+)
+
+const (
+	defaultLogLimit = 64 << 10
+	maxLogLimit     = 1 << 20
+)
+
+// ansiEscape matches terminal escape sequences (colors, cursor movement and
+// OSC titles/links).
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// handleProjectLogs serves a range of a run's output:
+//
+//	GET /api/v1/projects/{id}/logs?run=&offset=&limit=&format=text|json&strip_ansi=true
+//
+// run defaults to the latest run. Without offset the end of the output is
+// returned; clients follow a running pipeline by passing next_offset back.
+// format=text (the default) returns the lines as one string, format=json
+// returns them with their time, step and stream.
+func (h *Handler) handleProjectLogs(w http.ResponseWriter, r *http.Request, id string) {
+	if _, ok := h.store.GetProject(id); !ok {
+		h.wNotFound(w)
+		return
+	}
+	q := r.URL.Query()
+	run := q.Get("run")
+	if run == "" {
+		runs := h.store.GetRuns(id)
+		if len(runs) == 0 {
+			h.wNotFound(w)
+			return
+		}
+		run = runs[0].ID
+	}
+	offset := int64(-1)
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid offset"})
+			return
+		}
+		offset = n
+	}
+	limit := int64(defaultLogLimit)
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+	if limit > maxLogLimit {
+		limit = maxLogLimit
+	}
+	format := q.Get("format")
+	if format != "" && format != "text" && format != "json" {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "format must be text or json"})
+		return
+	}
+	chunk, err := h.logs.Read(id, run, offset, limit)
+	if err == logstore.ErrNotFound {
+		h.wNotFound(w)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	if q.Get("strip_ansi") == "true" {
+		for i := range chunk.Lines {
+			chunk.Lines[i].Text = ansiEscape.ReplaceAllString(chunk.Lines[i].Text, "")
+		}
+	}
+	if format == "json" {
+		writeJSON(w, chunk)
+		return
+	}
+	var data strings.Builder
+	for _, ln := range chunk.Lines {
+		data.WriteString(ln.String())
+		data.WriteByte('\n')
+	}
+	writeJSON(w, map[string]interface{}{
+		"run":         chunk.Run,
+		"offset":      chunk.Offset,
+		"next_offset": chunk.Next,
+		"start":       chunk.Start,
+		"size":        chunk.Size,
+		"data":        data.String(),
+	})
+}
+
+const (
+	defaultSearchLimit = 100
+	maxSearchLimit     = 1000
+	journalSearchLines = 5000
+)
+
+// handleLogSearch searches stored run output and, for the requested systemd
+// units, the journal:
+//
+//	GET /api/v1/logs/search?q=EADDRINUSE&project=api&since=24h&unit=nginx.service
+//
+// q is a substring, or a regular expression with regex=true; i=true makes
+// either case-insensitive. project and unit may be repeated. since and
+// until take RFC 3339 times or a duration back from now. Run hits carry the
+// run ID and the offset of the line for use with the logs endpoint.
+func (h *Handler) handleLogSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	query, err := searchQuery(q)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+
+	projects := q["project"]
+	if len(projects) == 0 {
+		for _, p := range h.store.GetProjects() {
+			projects = append(projects, p.ID)
+		}
+	}
+	hits := []logstore.Hit{}
+	for _, id := range projects {
+		for _, run := range h.store.GetRuns(id) {
+			if !query.Until.IsZero() && run.StartedAt.After(query.Until) {
+				continue
+			}
+			if !query.Since.IsZero() && run.FinishedAt != nil && run.FinishedAt.Before(query.Since) {
+				continue
+			}
+			found, err := h.logs.SearchRun(id, run.ID, query, run.Status != "RUNNING")
+			if err != nil && err != logstore.ErrNotFound {
+				log.Printf("log search %s/%s: %v", id, run.ID, err)
+			}
+			hits = append(hits, found...)
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Time.After(hits[j].Time) })
+	truncated := len(hits) > query.Limit
+	if truncated {
+		hits = hits[:query.Limit]
+	}
+
+	journal := []systemd.JournalEntry{}
+	for _, unit := range q["unit"] {
+		entries, err := h.sd.JournalRange(unit, query.Since, query.Until, journalSearchLines)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			writeJSON(w, map[string]string{"error": "journal: " + err.Error()})
+			return
+		}
+		for i := len(entries) - 1; i >= 0 && len(journal) < query.Limit; i-- {
+			if query.Match(entries[i].Message) {
+				journal = append(journal, entries[i])
+			}
+		}
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"runs":      hits,
+		"journal":   journal,
+		"truncated": truncated,
+	})
+}
+
+// searchQuery builds a logstore query from search parameters.
+func searchQuery(q url.Values) (logstore.Query, error) {
+	var query logstore.Query
+	text := q.Get("q")
+	if text == "" {
+		return query, errors.New("q required")
+	}
+	fold := q.Get("i") == "true"
+	if q.Get("regex") == "true" {
+		expr := text
+		if fold {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return query, fmt.Errorf("invalid regex: %v", err)
+		}
+		query.Match = re.MatchString
+		query.Literal, _ = re.LiteralPrefix()
+	} else {
+		query.Literal = text
+		if fold {
+			lower := strings.ToLower(text)
+			query.Match = func(s string) bool { return strings.Contains(strings.ToLower(s), lower) }
+		} else {
+			query.Match = func(s string) bool { return strings.Contains(s, text) }
+		}
+	}
+
+	var err error
+	if query.Since, err = parseSearchTime(q.Get("since")); err != nil {
+		return query, fmt.Errorf("invalid since: %v", err)
+	}
+	if query.Until, err = parseSearchTime(q.Get("until")); err != nil {
+		return query, fmt.Errorf("invalid until: %v", err)
+	}
+
+	query.Limit = defaultSearchLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return query, errors.New("invalid limit")
+		}
+		query.Limit = n
+	}
+	if query.Limit > maxSearchLimit {
+		query.Limit = maxSearchLimit
+	}
+	return query, nil
+}
+
+// parseSearchTime accepts an RFC 3339 time or a duration before now.
+func parseSearchTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
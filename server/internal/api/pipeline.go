@@ -0,0 +1,856 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/git"
+	"github.com/davidrocha/pi-manager/internal/logstore"
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+var (
+	errProjectNotFound  = errors.New("project not found")
+	errAlreadyRunning   = errors.New("project already running")
+	errBadPipeline      = errors.New("pipeline cannot be resolved")
+	errBadStepSelection = errors.New("invalid step selection")
+)
+
+// runOptions describes why and how a pipeline run is started.
+type runOptions struct {
+	Trigger string // manual, schedule, deploy, ...
+	Deploy  bool   // fetch and check out Ref before running the pipeline
+	Ref     string // ref to deploy, defaults to the project branch
+
+	FromStep string // run only this step and the steps after (depending on) it
+	OnlyStep string // run only this step
+}
+
+// task is a running pipeline as recorded in activeTasks.
+type task struct {
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the pipeline has finished
+}
+
+// newRunID returns a sortable identifier for a new run.
+func newRunID() string {
+	return strconv.FormatInt(time.Now().UnixMilli(), 10)
+}
+
+// startProject launches the project's pipeline in the background and returns
+// the id of the recorded run. A project with a task in activeTasks is
+// considered running and is not started twice.
+func (h *Handler) startProject(id string, opts runOptions) (string, error) {
+	p, ok := h.store.GetProject(id)
+	if !ok {
+		return "", errProjectNotFound
+	}
+	if opts.Trigger == "" {
+		opts.Trigger = "manual"
+	}
+	if opts.Deploy && opts.Ref == "" {
+		opts.Ref = p.Branch
+	}
+	steps, err := h.resolvePipeline(p)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errBadPipeline, err)
+	}
+	if steps, err = selectSteps(steps, opts.FromStep, opts.OnlyStep); err != nil {
+		return "", err
+	}
+
+	// Run in background
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &task{cancel: cancel, done: make(chan struct{})}
+	if _, running := h.activeTasks.LoadOrStore(id, t); running {
+		cancel()
+		return "", errAlreadyRunning
+	}
+	// report BOOTING right away so callers never observe the previous status
+	h.store.UpdateRuntime(id, func(p *state.ProjectRuntime) { p.Status = "BOOTING" })
+
+	run := state.Run{
+		ID:        newRunID(),
+		Project:   id,
+		Trigger:   opts.Trigger,
+		Ref:       opts.Ref,
+		FromStep:  opts.FromStep,
+		OnlyStep:  opts.OnlyStep,
+		Status:    "RUNNING",
+		StartedAt: time.Now(),
+	}
+	h.store.AddRun(run)
+	lg, err := h.logs.Create(id, run.ID)
+	if err != nil {
+		log.Printf("run %s/%s: output is not stored: %v", id, run.ID, err)
+	}
+	var keep []string
+	for _, r := range h.store.GetRuns(id) {
+		keep = append(keep, r.ID)
+	}
+	h.logs.Prune(id, keep)
+
+	go h.runPipeline(ctx, t, &pipelineRun{h: h, proj: p, steps: steps, runID: run.ID, log: lg}, opts)
+
+	return run.ID, nil
+}
+
+// deployCheckout brings the project's working copy to ref, cloning the
+// configured repository first when Path is not a checkout yet.
+func deployCheckout(ctx context.Context, p state.Project, ref string, out io.Writer) error {
+	if p.Path == "" {
+		return errors.New("project has no path to deploy into")
+	}
+	if !git.IsRepository(p.Path) {
+		if p.Repo == "" {
+			return fmt.Errorf("%s: %w and no repo configured", p.Path, git.ErrNotRepository)
+		}
+		if err := git.Clone(ctx, p.Repo, p.Branch, p.Path, out); err != nil {
+			return err
+		}
+		if ref == "" || ref == p.Branch {
+			return nil
+		}
+	} else if err := git.Fetch(ctx, p.Path, out); err != nil {
+		return err
+	}
+	if ref == "" {
+		st, err := git.GetStatus(p.Path)
+		if err != nil {
+			return err
+		}
+		if st.Branch == "" {
+			return errors.New("no ref given and the checkout is not on a branch")
+		}
+		ref = st.Branch
+	}
+	return git.Checkout(ctx, p.Path, ref, out)
+}
+
+// pipelineRun carries the state shared by the steps of one execution.
+type pipelineRun struct {
+	h     *Handler
+	runID string
+	steps []state.PipelineStep // resolved pipeline, see resolvePipeline
+
+	lock sync.Mutex // guards proj
+	proj state.Project
+	log  *logstore.Log // run output; proj.LastLog mirrors its tail
+
+	changed []string // files changed since the last successful run, loaded lazily
+	diffErr error
+	diffed  bool
+}
+
+// logf records a message of the pipeline itself and publishes it.
+func (pr *pipelineRun) logf(format string, args ...interface{}) {
+	pr.stepLogf("", format, args...)
+}
+
+// stepLogf is logf for messages about a step.
+func (pr *pipelineRun) stepLogf(step, format string, args ...interface{}) {
+	pr.log.System(step, fmt.Sprintf(format, args...))
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	pr.proj.LastLog = pr.log.Tail()
+	pr.saveRuntime()
+}
+
+// saveRuntime publishes the run's status and progress. It only writes the
+// fields the pipeline maintains, leaving the configuration and the
+// scheduler's fields alone. pr.lock must be held.
+func (pr *pipelineRun) saveRuntime() {
+	rt := pr.proj.ProjectRuntime
+	pr.h.store.UpdateRuntime(pr.proj.ID, func(r *state.ProjectRuntime) {
+		r.Status, r.LastLog, r.CurrentStep, r.Progress = rt.Status, rt.LastLog, rt.CurrentStep, rt.Progress
+		r.ListeningPorts = rt.ListeningPorts
+	})
+}
+
+// writer returns a writer feeding a stream of a step's output into the run
+// log. It must be flushed once the command has finished.
+func (pr *pipelineRun) writer(step, stream string) *logWriter {
+	return &logWriter{h: pr.h, proj: &pr.proj, projLock: &pr.lock, log: pr.log, lines: pr.log.LineWriter(step, stream)}
+}
+
+func (h *Handler) runPipeline(ctx context.Context, t *task, pr *pipelineRun, opts runOptions) {
+	id := pr.proj.ID
+	defer close(t.done)
+	// a restart may already have registered the next task
+	defer h.activeTasks.CompareAndDelete(id, t)
+	defer t.cancel()
+
+	pr.lock.Lock()
+	pr.proj.Status = "BOOTING"
+	pr.proj.LastLog = ""
+	pr.proj.Progress = 0
+	pr.proj.ListeningPorts = nil
+	pr.saveRuntime() // Update status to BOOTING
+	pr.lock.Unlock()
+
+	switch {
+	case opts.OnlyStep != "":
+		pr.logf("===> Running only step %s\n", opts.OnlyStep)
+	case opts.FromStep != "":
+		pr.logf("===> Resuming from step %s\n", opts.FromStep)
+	}
+
+	var finalErr error
+	// failed is set when the deploy checkout fails; every step then sees an
+	// earlier failure and only runs if its condition asks for it.
+	failed := false
+
+	if opts.Deploy {
+		pr.logf("===> Deploying %s\n", orDefault(opts.Ref, "current branch"))
+		out := pr.writer("deploy", logstore.Stdout)
+		err := deployCheckout(ctx, pr.proj, opts.Ref, out)
+		out.Flush()
+		if err != nil {
+			pr.logf("\nERROR during deploy: %v\n", err)
+			finalErr = err
+			failed = true
+		}
+	}
+	if pr.proj.Path != "" {
+		if commit, err := git.Head(pr.proj.Path); err == nil {
+			h.store.UpdateRun(id, pr.runID, func(r *state.Run) { r.Commit = commit })
+		}
+	}
+
+	if err := pr.runGraph(ctx, failed); err != nil && (finalErr == nil || ctx.Err() != nil) {
+		finalErr = err
+	}
+	// a partial run's files are not a complete build
+	if finalErr == nil && opts.FromStep == "" && opts.OnlyStep == "" {
+		pr.collectArtifacts()
+	}
+
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	pr.proj.CurrentStep = ""
+	if finalErr != nil {
+		// A canceled context means the project was stopped by the user
+		if finalErr == context.Canceled || ctx.Err() == context.Canceled {
+			pr.proj.Status = "IDLE"
+			pr.log.System("", "\nStopped by user.")
+		} else {
+			pr.proj.Status = "FAILED"
+		}
+	} else {
+		pr.proj.Status = "ACTIVE"
+	}
+	pr.proj.LastLog = pr.log.Tail()
+	pr.log.Close()
+	pr.saveRuntime()
+	h.store.UpdateRun(id, pr.runID, func(r *state.Run) {
+		now := time.Now()
+		r.FinishedAt = &now
+		switch pr.proj.Status {
+		case "ACTIVE":
+			r.Status = "SUCCEEDED"
+		case "FAILED":
+			r.Status = "FAILED"
+		default:
+			r.Status = "CANCELED"
+		}
+	})
+	h.store.Snapshot()
+}
+
+// selectSteps narrows a pipeline for a partial run. With only, just that
+// step runs. With from, the step and every step after it run: in a pipeline
+// using needs, "after" means the steps depending on it, directly or not.
+// Dependencies on steps left out are dropped.
+func selectSteps(steps []state.PipelineStep, from, only string) ([]state.PipelineStep, error) {
+	if from == "" && only == "" {
+		return steps, nil
+	}
+	if from != "" && only != "" {
+		return nil, fmt.Errorf("%w: from_step and only_step cannot be combined", errBadStepSelection)
+	}
+	name := from + only
+	start := -1
+	for i, st := range steps {
+		if st.Name == name {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("%w: unknown step %q", errBadStepSelection, name)
+	}
+	if only != "" {
+		st := steps[start]
+		st.Needs = nil
+		return []state.PipelineStep{st}, nil
+	}
+
+	nodes, _, err := buildGraph(steps)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadPipeline, err)
+	}
+	keep := map[string]bool{}
+	var out []state.PipelineStep
+	for i, n := range nodes {
+		selected := i == start
+		for _, j := range n.ancestors {
+			selected = selected || j == start
+		}
+		if selected {
+			keep[n.step.Name] = true
+			out = append(out, n.step)
+		}
+	}
+	for i := range out {
+		var needs []string
+		for _, need := range out[i].Needs {
+			if keep[need] {
+				needs = append(needs, need)
+			}
+		}
+		out[i].Needs = needs
+	}
+	return out, nil
+}
+
+// defaultMaxParallel bounds concurrently running steps when a project does
+// not set max_parallel.
+const defaultMaxParallel = 2
+
+// states of a step while runGraph executes a pipeline
+const (
+	stepPending = iota
+	stepRunning
+	stepDone
+)
+
+// stepNode is a pipeline step with its dependencies resolved to indexes.
+type stepNode struct {
+	step      state.PipelineStep
+	needs     []int
+	ancestors []int // transitive dependencies
+}
+
+// buildGraph resolves step dependencies. Pipelines in which no step declares
+// "needs" run strictly in order, each step depending on the one before it;
+// parallel reports whether explicit dependencies were used.
+func buildGraph(steps []state.PipelineStep) (nodes []stepNode, parallel bool, err error) {
+	index := make(map[string]int, len(steps))
+	for i, st := range steps {
+		if len(st.Needs) > 0 {
+			parallel = true
+		}
+		if _, dup := index[st.Name]; dup {
+			if parallel || st.Name == "" {
+				// names only need to be unique once they are referenced
+				continue
+			}
+		}
+		index[st.Name] = i
+	}
+	nodes = make([]stepNode, len(steps))
+	for i, st := range steps {
+		nodes[i].step = st
+		if !parallel {
+			if i > 0 {
+				nodes[i].needs = []int{i - 1}
+			}
+			continue
+		}
+		for _, need := range st.Needs {
+			j, ok := index[need]
+			if !ok {
+				return nil, false, fmt.Errorf("step %s needs unknown step %q", st.Name, need)
+			}
+			if j == i {
+				return nil, false, fmt.Errorf("step %s needs itself", st.Name)
+			}
+			nodes[i].needs = append(nodes[i].needs, j)
+		}
+	}
+	if parallel {
+		seen := map[string]bool{}
+		for _, st := range steps {
+			if st.Name == "" || seen[st.Name] {
+				return nil, false, fmt.Errorf("step names must be unique and non-empty when needs is used (%q)", st.Name)
+			}
+			seen[st.Name] = true
+		}
+	}
+
+	// depth-first walk to detect cycles and collect ancestors
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	mark := make([]int, len(nodes))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch mark[i] {
+		case visiting:
+			return fmt.Errorf("dependency cycle through step %s", nodes[i].step.Name)
+		case visited:
+			return nil
+		}
+		mark[i] = visiting
+		anc := map[int]bool{}
+		for _, j := range nodes[i].needs {
+			if err := visit(j); err != nil {
+				return err
+			}
+			anc[j] = true
+			for _, k := range nodes[j].ancestors {
+				anc[k] = true
+			}
+		}
+		for k := range anc {
+			nodes[i].ancestors = append(nodes[i].ancestors, k)
+		}
+		sort.Ints(nodes[i].ancestors)
+		mark[i] = visited
+		return nil
+	}
+	for i := range nodes {
+		if err := visit(i); err != nil {
+			return nil, false, err
+		}
+	}
+	return nodes, parallel, nil
+}
+
+// runGraph executes the pipeline steps as a DAG, starting a step once all of
+// its dependencies have finished and at most max_parallel steps at a time.
+// It returns the first error of a step that failed the pipeline.
+func (pr *pipelineRun) runGraph(ctx context.Context, failed bool) error {
+	nodes, parallel, err := buildGraph(pr.steps)
+	if err != nil {
+		pr.logf("ERROR: %v\n", err)
+		return err
+	}
+	limit := 1
+	if parallel {
+		limit = pr.proj.MaxParallel
+		if limit <= 0 {
+			limit = defaultMaxParallel
+		}
+	}
+
+	total := len(nodes)
+	status := make([]int, total)
+	stepFailed := make([]bool, total)
+	type result struct {
+		i   int
+		err error
+	}
+	results := make(chan result)
+	var firstErr error
+	active, completed := 0, 0
+
+	ready := func(n stepNode) bool {
+		for _, j := range n.needs {
+			if status[j] != stepDone {
+				return false
+			}
+		}
+		return true
+	}
+	upstreamFailed := func(n stepNode) bool {
+		if failed {
+			return true
+		}
+		for _, j := range n.ancestors {
+			if stepFailed[j] {
+				return true
+			}
+		}
+		return false
+	}
+
+	for completed < total {
+		skipped := false
+		for i, n := range nodes {
+			if ctx.Err() != nil || active >= limit {
+				break
+			}
+			if status[i] != stepPending || !ready(n) {
+				continue
+			}
+			if ok, why := pr.shouldRun(n.step, upstreamFailed(n)); !ok {
+				pr.logf("===> [%d/%d] Skipping Step: %s (%s)\n\n", i+1, total, n.step.Name, why)
+				status[i] = stepDone
+				completed++
+				skipped = true
+				continue
+			}
+			status[i] = stepRunning
+			active++
+			pr.logf("===> [%d/%d] Running Step: %s\n", i+1, total, n.step.Name)
+			go func(i int, step state.PipelineStep) {
+				results <- result{i, pr.runStep(ctx, step)}
+			}(i, n.step)
+		}
+		pr.setProgress(nodes, status, completed)
+		if skipped {
+			// a skipped step may have unblocked its dependents
+			continue
+		}
+		if active == 0 {
+			// cancelled; nothing left in flight
+			break
+		}
+
+		res := <-results
+		active--
+		status[res.i] = stepDone
+		completed++
+		step := nodes[res.i].step
+		switch {
+		case res.err == nil:
+			pr.logf("\n")
+		case ctx.Err() != nil:
+		case step.ContinueOnError:
+			pr.logf("\nERROR in step '%s': %v\nContinuing: step allows errors.\n\n", step.Name, res.err)
+		default:
+			pr.logf("\nERROR in step '%s': %v\n\n", step.Name, res.err)
+			stepFailed[res.i] = true
+			if firstErr == nil {
+				firstErr = res.err
+			}
+		}
+	}
+	pr.setProgress(nodes, status, completed)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// setProgress publishes the running steps and the share of finished ones.
+func (pr *pipelineRun) setProgress(nodes []stepNode, status []int, completed int) {
+	var names []string
+	for i, n := range nodes {
+		if status[i] == stepRunning {
+			names = append(names, n.step.Name)
+		}
+	}
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	pr.proj.CurrentStep = strings.Join(names, ", ")
+	if len(nodes) > 0 {
+		pr.proj.Progress = completed * 100 / len(nodes)
+	}
+	pr.saveRuntime()
+}
+
+// defaultBackoff is the delay before the first retry of a failed step.
+const defaultBackoff = 5 * time.Second
+
+// maxBackoff caps the delay between retries, and maxRetries the retries of
+// a step, so a failing step cannot hold its pipeline for hours.
+const (
+	maxBackoff = 5 * time.Minute
+	maxRetries = 10
+)
+
+// runStep executes a step, retrying failures with exponential backoff.
+func (pr *pipelineRun) runStep(ctx context.Context, step state.PipelineStep) error {
+	stdout := pr.writer(step.Name, logstore.Stdout)
+	stderr := pr.writer(step.Name, logstore.Stderr)
+	defer stdout.Flush()
+	defer stderr.Flush()
+	backoff := defaultBackoff
+	if step.Backoff != "" {
+		backoff, _ = time.ParseDuration(step.Backoff)
+	}
+	for attempt := 1; ; attempt++ {
+		err := pr.execStep(ctx, step, stdout, stderr)
+		if err == nil || ctx.Err() != nil || attempt > step.Retries {
+			return err
+		}
+		stdout.Flush()
+		stderr.Flush()
+		pr.stepLogf(step.Name, "Step '%s' failed: %v. Retrying in %s (attempt %d/%d)\n", step.Name, err, backoff, attempt+1, step.Retries+1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// execStep runs a single attempt of a step's command.
+func (pr *pipelineRun) execStep(ctx context.Context, step state.PipelineStep, stdout, stderr io.Writer) error {
+	h := pr.h
+	var timeout time.Duration
+	if step.Timeout != "" {
+		timeout, _ = time.ParseDuration(step.Timeout)
+	}
+	stepCtx, cancel := context.WithCancel(ctx)
+	if timeout > 0 {
+		stepCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	cmdStr := step.Cmd
+	if strings.Contains(cmdStr, "boot.sh") || strings.Contains(cmdStr, "dev.sh") {
+		cmdStr = "tailscale up && " + cmdStr
+	}
+
+	// cancellation is handled below so the process group can stop gracefully
+	cmd := exec.Command("sh", "-c", cmdStr)
+	cmd.Dir = pr.stepDir(step)
+	// Set process group so we can kill children (like dev servers)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// out updates the store in real-time
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	var stdin *os.File
+	if pr.proj.Interactive {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		cmd.Stdin = r
+		stdin = w
+	}
+
+	if err := cmd.Start(); err != nil {
+		pr.stepLogf(step.Name, "Failed to start: %v\n", err)
+		return err
+	}
+	// with Setpgid the shell leads a new group whose id is its pid
+	pgid := cmd.Process.Pid
+	h.procs.add(pr.proj.ID, pgid)
+	if stdin != nil {
+		h.stdins.Store(pr.proj.ID, stdin)
+		defer func() {
+			h.stdins.CompareAndDelete(pr.proj.ID, stdin)
+			stdin.Close()
+		}()
+	}
+
+	// Attempt auto-discovery of ports
+	go func(pid int) {
+		// Wait a moment for process to establish PGID
+		time.Sleep(500 * time.Millisecond)
+		pgid, err := syscall.Getpgid(pid)
+		if err != nil {
+			pgid = pid // fallback
+		}
+
+		// Try multiple times over a few seconds
+		for i := 0; i < 30; i++ {
+			time.Sleep(1 * time.Second)
+			ports := findPortsForPGID(pgid)
+			if len(ports) > 0 {
+				pr.lock.Lock()
+				// Update if ports list changed, regardless of status (active services might persist after boot script)
+				if !slicesEqual(pr.proj.ListeningPorts, ports) {
+					pr.proj.ListeningPorts = ports
+					h.store.UpdateRuntime(pr.proj.ID, func(r *state.ProjectRuntime) { r.ListeningPorts = ports })
+				}
+				pr.lock.Unlock()
+			}
+		}
+	}(cmd.Process.Pid)
+
+	// Stop the entire process group if the step is cancelled or times out
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stepCtx.Done():
+			sig, grace := stopSettings(pr.proj)
+			terminate([]int{-pgid}, sig, grace)
+		case <-done:
+		}
+	}()
+
+	err := cmd.Wait()
+	if err != nil && stepCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
+
+// stepDir resolves the directory a step runs in.
+func (pr *pipelineRun) stepDir(step state.PipelineStep) string {
+	if step.WorkingDir == "" {
+		return pr.proj.Path
+	}
+	if filepath.IsAbs(step.WorkingDir) {
+		return step.WorkingDir
+	}
+	return filepath.Join(pr.proj.Path, step.WorkingDir)
+}
+
+// shouldRun evaluates a step's "when" condition. failed tells whether an
+// earlier step failed the pipeline. The returned string explains a skip.
+func (pr *pipelineRun) shouldRun(step state.PipelineStep, failed bool) (bool, string) {
+	cond := strings.TrimSpace(step.When)
+	switch {
+	case cond == "always":
+		return true, ""
+	case cond == "failure":
+		return failed, "no earlier step failed"
+	case failed:
+		return false, "an earlier step failed"
+	case cond == "" || cond == "success":
+		return true, ""
+	case strings.HasPrefix(cond, "exists:"):
+		target := strings.TrimSpace(strings.TrimPrefix(cond, "exists:"))
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(pr.stepDir(step), target)
+		}
+		if _, err := os.Stat(target); err != nil {
+			return false, target + " does not exist"
+		}
+		return true, ""
+	case strings.HasPrefix(cond, "changed:"):
+		files, err := pr.changedFiles()
+		if err != nil {
+			// without a baseline to diff against, assume everything changed
+			return true, ""
+		}
+		for _, pattern := range strings.Split(strings.TrimPrefix(cond, "changed:"), ",") {
+			for _, f := range files {
+				if matchChanged(strings.TrimSpace(pattern), f) {
+					return true, ""
+				}
+			}
+		}
+		return false, "no matching files changed"
+	}
+	return false, "unknown condition " + cond
+}
+
+// changedFiles lists files changed between the commit of the last successful
+// full run and the current checkout. Partial runs do not count: the steps
+// they skipped may not have seen their commit.
+func (pr *pipelineRun) changedFiles() ([]string, error) {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+	if pr.diffed {
+		return pr.changed, pr.diffErr
+	}
+	pr.diffed = true
+	var base string
+	for _, r := range pr.h.store.GetRuns(pr.proj.ID) {
+		if r.ID != pr.runID && r.Status == "SUCCEEDED" && r.Commit != "" && r.FromStep == "" && r.OnlyStep == "" {
+			base = r.Commit
+			break
+		}
+	}
+	if base == "" {
+		pr.diffErr = errors.New("no previous successful run")
+		return nil, pr.diffErr
+	}
+	pr.changed, pr.diffErr = git.ChangedFiles(pr.proj.Path, base, "HEAD")
+	return pr.changed, pr.diffErr
+}
+
+// matchChanged matches a changed file against a "changed:" pattern. Patterns
+// ending in "/**" match everything below a directory; patterns without a
+// slash also match on the base name.
+func matchChanged(pattern, file string) bool {
+	if strings.HasSuffix(pattern, "/**") {
+		return strings.HasPrefix(file, strings.TrimSuffix(pattern, "**"))
+	}
+	if ok, _ := path.Match(pattern, file); ok {
+		return true
+	}
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(file))
+		return ok
+	}
+	return false
+}
+
+// stepError is a problem with a field of a pipeline step.
+type stepError struct {
+	index int    // position in the pipeline
+	field string // JSON key of the step field
+	msg   string
+}
+
+func (e *stepError) Error() string {
+	return e.msg
+}
+
+// validatePipeline checks step options submitted through the API.
+func validatePipeline(steps []state.PipelineStep) error {
+	if _, _, err := buildGraph(steps); err != nil {
+		return err
+	}
+	for i, st := range steps {
+		name := st.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		fail := func(field, format string, args ...interface{}) error {
+			return &stepError{index: i, field: field, msg: "step " + name + ": " + fmt.Sprintf(format, args...)}
+		}
+		if strings.TrimSpace(st.Cmd) == "" {
+			return fail("cmd", "cmd is required")
+		}
+		if st.Timeout != "" {
+			if d, err := time.ParseDuration(st.Timeout); err != nil || d <= 0 {
+				return fail("timeout", "invalid timeout %q", st.Timeout)
+			}
+		}
+		if st.Backoff != "" {
+			d, err := time.ParseDuration(st.Backoff)
+			if err != nil || d < 0 {
+				return fail("backoff", "invalid backoff %q", st.Backoff)
+			}
+			if d > maxBackoff {
+				return fail("backoff", "backoff must not exceed %s", maxBackoff)
+			}
+		}
+		if st.Retries < 0 || st.Retries > maxRetries {
+			return fail("retries", "retries must be between 0 and %d", maxRetries)
+		}
+		switch cond := strings.TrimSpace(st.When); {
+		case cond == "", cond == "success", cond == "failure", cond == "always":
+		case strings.HasPrefix(cond, "changed:"):
+			for _, pattern := range strings.Split(strings.TrimPrefix(cond, "changed:"), ",") {
+				if _, err := path.Match(strings.TrimSpace(pattern), ""); err != nil || strings.TrimSpace(pattern) == "" {
+					return fail("when", "invalid pattern in %q", cond)
+				}
+			}
+		case strings.HasPrefix(cond, "exists:"):
+			if strings.TrimSpace(strings.TrimPrefix(cond, "exists:")) == "" {
+				return fail("when", "exists: needs a path")
+			}
+		default:
+			return fail("when", "unknown when condition %q", cond)
+		}
+	}
+	return nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
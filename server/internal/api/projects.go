@@ -0,0 +1,402 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/git"
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// maxProjectBody bounds the size of a submitted project.
+const maxProjectBody = 1 << 20
+
+// readOnlyFields are project keys maintained by pi-manager. They are
+// ignored when a whole project is submitted, so a project read from the API
+// can be sent back, and refused in a patch.
+var readOnlyFields = map[string]bool{
+	"revision":           true,
+	"source":             true,
+	"runtime_revision":   true,
+	"status":             true,
+	"last_log":           true,
+	"current_step":       true,
+	"progress":           true,
+	"next_run":           true,
+	"last_scheduled_run": true,
+}
+
+// fieldError is a problem with one field of a submitted project.
+type fieldError struct {
+	Field   string `json:"field"` // JSON key, e.g. "ports[1]" or "pipeline[0].timeout"
+	Message string `json:"message"`
+}
+
+// validationError lists the problems found in a submitted project.
+type validationError []fieldError
+
+func (e validationError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// handleProjects supports GET to list and POST to create a project
+func (h *Handler) handleProjects(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ps := h.store.GetProjects()
+		writeJSON(w, ps)
+		return
+	case http.MethodPost:
+		var p state.Project
+		if err := decodeProject(r.Body, &p); err != nil {
+			writeInvalid(w, err)
+			return
+		}
+		if err := state.ValidProjectID(p.ID); err != nil {
+			writeInvalid(w, validationError{{Field: "id", Message: err.Error()}})
+			return
+		}
+		if _, exists := h.store.GetProject(p.ID); exists {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]string{"error": "project already exists; use PUT or PATCH to change it"})
+			return
+		}
+		h.createProject(w, p)
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+}
+
+// createProject validates and stores a new project.
+func (h *Handler) createProject(w http.ResponseWriter, p state.Project) {
+	p.Source = ""
+	if err := h.validateProject(p); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if _, ok := h.store.CreateProject(p.ProjectConfig); !ok {
+		w.WriteHeader(http.StatusConflict)
+		writeJSON(w, map[string]string{"error": "project already exists; use PUT or PATCH to change it"})
+		return
+	}
+	if err := h.store.Snapshot(); err != nil {
+		log.Printf("snapshot error: %v", err)
+	}
+	p, _ = h.store.GetProject(p.ID)
+	setETag(w, p)
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, p)
+}
+
+// updateProject handles PUT, which replaces a project's configuration or
+// creates the project, and PATCH, which applies a JSON merge patch (RFC
+// 7396) to it. The runtime state is kept either way. An If-Match header
+// with the project's ETag makes the update fail with 412 if someone else
+// changed the project since it was read.
+func (h *Handler) updateProject(w http.ResponseWriter, r *http.Request, id string) {
+	ifMatch := r.Header.Get("If-Match")
+	cur, exists := h.store.GetProject(id)
+	switch {
+	case !exists && (ifMatch != "" || r.Method == http.MethodPatch):
+		if ifMatch != "" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			writeJSON(w, map[string]string{"error": "project does not exist"})
+			return
+		}
+		h.wNotFound(w)
+		return
+	case exists && r.Header.Get("If-None-Match") == "*":
+		writePreconditionFailed(w, cur)
+		return
+	case exists && !etagMatches(ifMatch, cur.Revision):
+		writePreconditionFailed(w, cur)
+		return
+	}
+
+	var p state.Project
+	if r.Method == http.MethodPatch {
+		patched, err := applyMergePatch(r.Body, cur.ProjectConfig)
+		if err != nil {
+			writeInvalid(w, err)
+			return
+		}
+		p.ProjectConfig = patched
+	} else if err := decodeProject(r.Body, &p); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	if p.ID != "" && p.ID != id {
+		writeInvalid(w, validationError{{Field: "id", Message: "does not match the URL"}})
+		return
+	}
+	p.ID = id
+	if !exists {
+		h.createProject(w, p)
+		return
+	}
+
+	p.Source = cur.Source
+	if err := h.validateProject(p); err != nil {
+		writeInvalid(w, err)
+		return
+	}
+	// the update is based on the revision checked above; a change made
+	// since then is a conflict whether or not the client sent If-Match
+	if _, err := h.store.ReplaceProjectConfig(p.ProjectConfig, cur.Revision); err != nil {
+		if latest, ok := h.store.GetProject(id); ok && errors.Is(err, state.ErrRevisionMismatch) {
+			writePreconditionFailed(w, latest)
+			return
+		}
+		h.wNotFound(w)
+		return
+	}
+	if err := h.store.Snapshot(); err != nil {
+		log.Printf("snapshot error: %v", err)
+	}
+	p, _ = h.store.GetProject(id)
+	setETag(w, p)
+	writeJSON(w, p)
+}
+
+// decodeProject decodes a submitted project, rejecting unknown fields.
+func decodeProject(body io.Reader, p *state.Project) error {
+	dec := json.NewDecoder(io.LimitReader(body, maxProjectBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(p); err != nil {
+		return decodeError(err)
+	}
+	return nil
+}
+
+// applyMergePatch applies the JSON merge patch read from body to c.
+func applyMergePatch(body io.Reader, c state.ProjectConfig) (state.ProjectConfig, error) {
+	var patch map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(body, maxProjectBody)).Decode(&patch); err != nil {
+		return c, errors.New("invalid json")
+	}
+	var errs validationError
+	for k := range patch {
+		if readOnlyFields[k] {
+			errs = append(errs, fieldError{Field: k, Message: "maintained by pi-manager and cannot be set"})
+		}
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return c, err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return c, err
+	}
+	if data, err = json.Marshal(mergePatch(doc, patch)); err != nil {
+		return c, err
+	}
+	var out state.ProjectConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&out); err != nil {
+		return c, decodeError(err)
+	}
+	return out, nil
+}
+
+// mergePatch merges patch into doc: null removes a key, objects are merged
+// recursively and any other value replaces the target.
+func mergePatch(doc, patch map[string]interface{}) map[string]interface{} {
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	for k, v := range patch {
+		switch v := v.(type) {
+		case nil:
+			delete(doc, k)
+		case map[string]interface{}:
+			target, _ := doc[k].(map[string]interface{})
+			doc[k] = mergePatch(target, v)
+		default:
+			doc[k] = v
+		}
+	}
+	return doc
+}
+
+// decodeError turns JSON decoding errors about a field into a
+// validationError.
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return validationError{{Field: fieldPath(typeErr.Field), Message: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value)}}
+	}
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return validationError{{Field: strings.Trim(name, `"`), Message: "unknown field"}}
+	}
+	return errors.New("invalid json")
+}
+
+// fieldPath writes the path of a JSON decoding error, such as
+// "pipeline.0.timeout", the way field errors name fields:
+// "pipeline[0].timeout".
+func fieldPath(p string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(p, ".") {
+		switch _, err := strconv.Atoi(part); {
+		case err == nil:
+			b.WriteString("[" + part + "]")
+		case i > 0:
+			b.WriteString("." + part)
+		default:
+			b.WriteString(part)
+		}
+	}
+	return b.String()
+}
+
+// writeInvalid reports a rejected project: 422 with the fields at fault, or
+// 400 when the request could not be read at all.
+func writeInvalid(w http.ResponseWriter, err error) {
+	var verr validationError
+	if errors.As(err, &verr) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]interface{}{"error": "invalid project", "fields": verr})
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	writeJSON(w, map[string]string{"error": err.Error()})
+}
+
+func writePreconditionFailed(w http.ResponseWriter, cur state.Project) {
+	setETag(w, cur)
+	w.WriteHeader(http.StatusPreconditionFailed)
+	writeJSON(w, map[string]interface{}{"error": "project was changed since it was read", "revision": cur.Revision})
+}
+
+// setETag tags a project response with the revision of its configuration.
+func setETag(w http.ResponseWriter, p state.Project) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(p.Revision, 10)))
+}
+
+// etagMatches reports whether an If-Match header allows an update of a
+// project at revision rev. An empty header matches anything.
+func etagMatches(header string, rev int64) bool {
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == strconv.Quote(strconv.FormatInt(rev, 10)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateProject checks the configuration of a project before it is
+// stored, reporting every field at fault as a validationError.
+func (h *Handler) validateProject(p state.Project) error {
+	return validateProjectWith(p, h.store.GetTemplate, h.projectMap())
+}
+
+// validateProjectWith is validateProject against the given templates and
+// projects, which it modifies.
+func validateProjectWith(p state.Project, templates func(id string) (state.Template, bool), projects map[string]state.Project) error {
+	var errs validationError
+	add := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, fieldError{Field: field, Message: err.Error()})
+		}
+	}
+	add("id", state.ValidProjectID(p.ID))
+	steps, err := expandTemplate(p, templates)
+	if err != nil {
+		add("template", err)
+	} else if err := validatePipeline(steps); err != nil {
+		var stepErr *stepError
+		if errors.As(err, &stepErr) {
+			add(fmt.Sprintf("pipeline[%d].%s", stepErr.index, stepErr.field), err)
+		} else {
+			add("pipeline", err)
+		}
+	}
+	add("path", validateProjectPath(p))
+	if p.Branch != "" {
+		add("branch", git.ValidRef(p.Branch))
+	}
+	for i, port := range p.Ports {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			add(fmt.Sprintf("ports[%d]", i), fmt.Errorf("invalid port %q", port))
+		}
+	}
+	add("artifacts", validateArtifacts(p.Artifacts))
+	add("depends_on", checkDependencies(p, projects))
+	if p.HealthTimeout != "" {
+		if d, err := time.ParseDuration(p.HealthTimeout); err != nil || d <= 0 {
+			add("health_timeout", fmt.Errorf("invalid duration %q", p.HealthTimeout))
+		}
+	}
+	if _, err := parseSignal(p.StopSignal, syscall.SIGTERM); err != nil {
+		add("stop_signal", err)
+	}
+	if p.StopTimeout != "" {
+		if d, err := time.ParseDuration(p.StopTimeout); err != nil || d < 0 {
+			add("stop_timeout", fmt.Errorf("invalid duration %q", p.StopTimeout))
+		}
+	}
+	if _, err := parseSignal(p.ReloadSignal, syscall.SIGHUP); err != nil {
+		add("reload_signal", err)
+	}
+	if p.AutostartDelay != "" {
+		if d, err := time.ParseDuration(p.AutostartDelay); err != nil || d < 0 {
+			add("autostart_delay", fmt.Errorf("invalid duration %q", p.AutostartDelay))
+		}
+	}
+	add("schedule", validateSchedule(p.Schedule))
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// errNoDirectory is reported for the path of a project that is not cloned
+// from a repo and whose directory is missing.
+var errNoDirectory = errors.New("directory does not exist")
+
+// validateProjectPath requires an absolute path to an existing directory,
+// unless the project is cloned into it from its repo on deploy.
+func validateProjectPath(p state.Project) error {
+	if p.Path == "" {
+		return nil
+	}
+	if !filepath.IsAbs(p.Path) {
+		return errors.New("must be absolute")
+	}
+	info, err := os.Stat(p.Path)
+	switch {
+	case err == nil && !info.IsDir():
+		return errors.New("not a directory")
+	case errors.Is(err, os.ErrNotExist) && p.Repo == "":
+		return errNoDirectory
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return errors.New("cannot be accessed")
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/projectfile"
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+const projectSyncInterval = 5 * time.Second
+
+// syncResult reports what a sync did with one project.
+type syncResult struct {
+	ID     string   `json:"id"`
+	File   string   `json:"file,omitempty"`
+	Action string   `json:"action"` // created, updated, unchanged, deleted, invalid, kept
+	Fields []string `json:"fields,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// projectSync remembers the outcome of the last sync for the drift report.
+type projectSync struct {
+	mu      sync.Mutex // held while syncing
+	at      time.Time
+	results []syncResult
+}
+
+// watchProjects syncs the projects directory whenever its definitions
+// change, and once a project kept because it was running has stopped.
+func (h *Handler) watchProjects() {
+	last := projectfile.Fingerprint(h.options().ProjectsDir)
+	for {
+		time.Sleep(projectSyncInterval)
+		dir := h.options().ProjectsDir
+		if dir == "" {
+			continue
+		}
+		if fp := projectfile.Fingerprint(dir); fp != last || h.keptStopped() {
+			last = fp
+			h.syncProjects()
+		}
+	}
+}
+
+// keptStopped reports whether a project the last sync kept, because its
+// definition was removed while it ran, is no longer running.
+func (h *Handler) keptStopped() bool {
+	h.sync.mu.Lock()
+	defer h.sync.mu.Unlock()
+	for _, r := range h.sync.results {
+		if r.Action != "kept" {
+			continue
+		}
+		if _, running := h.activeTasks.Load(r.ID); !running {
+			return true
+		}
+	}
+	return false
+}
+
+// syncProjects makes the projects defined in the projects directory match
+// their files: new definitions are created, changed ones updated with
+// their runtime state kept, and projects whose file was removed deleted.
+// Projects created through the API are left alone unless a file with
+// their id appears, which then takes them over.
+func (h *Handler) syncProjects() []syncResult {
+	dir := h.options().ProjectsDir
+	if dir == "" {
+		return nil
+	}
+	h.sync.mu.Lock()
+	defer h.sync.mu.Unlock()
+
+	files, err := projectfile.LoadDir(dir)
+	if err != nil {
+		log.Printf("project sync: %v", err)
+		return nil
+	}
+	var results []syncResult
+	defined := map[string]bool{}
+	var pending []projectfile.File
+	for _, f := range files {
+		defined[f.ID] = true
+		if f.Err != nil {
+			results = append(results, syncResult{ID: f.ID, File: f.Path, Action: "invalid", Error: f.Err.Error()})
+			continue
+		}
+		pending = append(pending, f)
+	}
+
+	// a definition may depend on one applied later in the same sync, so
+	// retry the invalid ones as long as others make progress
+	changed := false
+	for len(pending) > 0 {
+		var failed []projectfile.File
+		var errs []error
+		for _, f := range pending {
+			r, err := h.applyDefinition(f)
+			if err != nil {
+				failed = append(failed, f)
+				errs = append(errs, err)
+				continue
+			}
+			changed = changed || r.Action != "unchanged"
+			results = append(results, r)
+		}
+		if len(failed) == len(pending) {
+			for i, f := range failed {
+				results = append(results, syncResult{ID: f.ID, File: f.Path, Action: "invalid", Error: errs[i].Error()})
+			}
+			break
+		}
+		pending = failed
+	}
+
+	for _, p := range h.store.GetProjects() {
+		if p.Source == "" || filepath.Dir(p.Source) != filepath.Clean(dir) || defined[p.ID] {
+			continue
+		}
+		if _, running := h.activeTasks.Load(p.ID); running {
+			results = append(results, syncResult{ID: p.ID, File: p.Source, Action: "kept", Error: "definition removed while the project is running"})
+			continue
+		}
+		h.deleteProject(p.ID)
+		results = append(results, syncResult{ID: p.ID, File: p.Source, Action: "deleted"})
+		changed = true
+	}
+
+	if changed {
+		if err := h.store.Snapshot(); err != nil {
+			log.Printf("snapshot error: %v", err)
+		}
+	}
+	for _, r := range results {
+		switch {
+		case r.Error != "":
+			log.Printf("project sync: %s %s: %s", r.ID, r.Action, r.Error)
+		case r.Action != "unchanged":
+			log.Printf("project sync: %s %s", r.ID, r.Action)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+	h.sync.at = time.Now()
+	h.sync.results = results
+	return results
+}
+
+// applyDefinition creates or updates the project defined by f.
+func (h *Handler) applyDefinition(f projectfile.File) (syncResult, error) {
+	p := f.Project
+	p.Source = f.Path
+	if err := h.validateProject(p); err != nil {
+		return syncResult{}, err
+	}
+	r := syncResult{ID: p.ID, File: f.Path}
+	cur, ok := h.store.GetProject(p.ID)
+	if !ok {
+		h.store.PutProjectConfig(p.ProjectConfig)
+		r.Action = "created"
+		return r, nil
+	}
+	r.Fields = projectfile.Diff(cur, p)
+	if len(r.Fields) == 0 && cur.Source == p.Source {
+		r.Action = "unchanged"
+		return r, nil
+	}
+	h.store.PutProjectConfig(p.ProjectConfig)
+	r.Action = "updated"
+	return r, nil
+}
+
+// handleProjectConfig serves the projects-as-code endpoints:
+//
+//	GET  /api/v1/config/projects         drift between the definitions and the projects
+//	POST /api/v1/config/projects/sync    sync the projects directory now
+//	GET  /api/v1/config/projects/export  projects as YAML definitions (?id= to select)
+//	POST /api/v1/config/projects/export  write definitions into the projects directory
+func (h *Handler) handleProjectConfig(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/api/v1/config/projects" && r.Method == http.MethodGet:
+		h.projectDrift(w)
+	case r.URL.Path == "/api/v1/config/projects/sync" && r.Method == http.MethodPost:
+		if h.options().ProjectsDir == "" {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]string{"error": "no projects directory configured"})
+			return
+		}
+		writeJSON(w, map[string]interface{}{"results": h.syncProjects()})
+	case r.URL.Path == "/api/v1/config/projects/export" && r.Method == http.MethodGet:
+		h.exportProjects(w, r)
+	case r.URL.Path == "/api/v1/config/projects/export" && r.Method == http.MethodPost:
+		h.writeDefinitions(w, r)
+	case r.URL.Path == "/api/v1/config/projects" || r.URL.Path == "/api/v1/config/projects/sync" || r.URL.Path == "/api/v1/config/projects/export":
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		h.wNotFound(w)
+	}
+}
+
+// driftEntry compares a definition file with the project in the store.
+type driftEntry struct {
+	ID     string   `json:"id"`
+	File   string   `json:"file,omitempty"`
+	Status string   `json:"status"` // in_sync, drifted, invalid, missing, unmanaged
+	Fields []string `json:"fields,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+func (h *Handler) projectDrift(w http.ResponseWriter) {
+	dir := h.options().ProjectsDir
+	var entries []driftEntry
+	defined := map[string]bool{}
+	if dir != "" {
+		files, err := projectfile.LoadDir(dir)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			writeJSON(w, map[string]string{"error": err.Error()})
+			return
+		}
+		for _, f := range files {
+			defined[f.ID] = true
+			e := driftEntry{ID: f.ID, File: f.Path}
+			cur, ok := h.store.GetProject(f.ID)
+			switch {
+			case f.Err != nil:
+				e.Status, e.Error = "invalid", f.Err.Error()
+			case !ok:
+				e.Status = "missing"
+				if err := h.validateProject(f.Project); err != nil {
+					e.Error = err.Error()
+				}
+			default:
+				e.Fields = projectfile.Diff(f.Project, cur)
+				e.Status = "in_sync"
+				if len(e.Fields) > 0 || cur.Source != f.Path {
+					e.Status = "drifted"
+				}
+			}
+			entries = append(entries, e)
+		}
+	}
+	for _, p := range h.store.GetProjects() {
+		if !defined[p.ID] {
+			entries = append(entries, driftEntry{ID: p.ID, File: p.Source, Status: "unmanaged"})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	h.sync.mu.Lock()
+	lastSync, results := h.sync.at, h.sync.results
+	h.sync.mu.Unlock()
+	resp := map[string]interface{}{"dir": dir, "projects": entries, "last_sync": nil, "last_results": results}
+	if !lastSync.IsZero() {
+		resp["last_sync"] = lastSync
+	}
+	writeJSON(w, resp)
+}
+
+func (h *Handler) exportProjects(w http.ResponseWriter, r *http.Request) {
+	projects, ok := h.selectProjects(w, r.URL.Query()["id"])
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+	for i, p := range projects {
+		data, err := projectfile.Encode(p)
+		if err != nil {
+			log.Printf("export %s: %v", p.ID, err)
+			continue
+		}
+		if i > 0 {
+			w.Write([]byte("---\n"))
+		}
+		w.Write(data)
+	}
+}
+
+// writeDefinitions writes definitions of the selected projects (default:
+// those not yet defined by a file) into the projects directory. The
+// projects then follow their files.
+func (h *Handler) writeDefinitions(w http.ResponseWriter, r *http.Request) {
+	dir := h.options().ProjectsDir
+	if dir == "" {
+		w.WriteHeader(http.StatusConflict)
+		writeJSON(w, map[string]string{"error": "no projects directory configured"})
+		return
+	}
+	var body struct {
+		IDs       []string `json:"ids"`
+		Overwrite bool     `json:"overwrite"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid json"})
+			return
+		}
+	}
+	projects, ok := h.selectProjects(w, body.IDs)
+	if !ok {
+		return
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	written := []string{}
+	for _, p := range projects {
+		if len(body.IDs) == 0 && p.Source != "" {
+			continue
+		}
+		path := filepath.Join(dir, p.ID+projectfile.Suffix)
+		if _, err := os.Stat(path); err == nil && !body.Overwrite {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]interface{}{"error": path + " already exists", "written": written})
+			return
+		}
+		data, err := projectfile.Encode(p)
+		if err == nil {
+			err = os.WriteFile(path, data, 0o644)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			writeJSON(w, map[string]interface{}{"error": err.Error(), "written": written})
+			return
+		}
+		written = append(written, path)
+	}
+	h.syncProjects()
+	writeJSON(w, map[string]interface{}{"written": written})
+}
+
+// selectProjects returns the projects with the given ids, or all of them,
+// sorted by id. It writes a 404 response for unknown ids.
+func (h *Handler) selectProjects(w http.ResponseWriter, ids []string) ([]state.Project, bool) {
+	var out []state.Project
+	if len(ids) == 0 {
+		out = h.store.GetProjects()
+	}
+	for _, id := range ids {
+		p, ok := h.store.GetProject(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			writeJSON(w, map[string]string{"error": "project not found: " + id})
+			return nil, false
+		}
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, true
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davidrocha/pi-manager/internal/logstore"
+	"github.com/davidrocha/pi-manager/internal/projectfile"
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// newSyncHandler returns a handler syncing from its own projects directory,
+// without the background work NewHandler starts.
+func newSyncHandler(t *testing.T) (*Handler, string) {
+	t.Helper()
+	dir := t.TempDir()
+	s := state.NewStore(filepath.Join(dir, "state.json"))
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	h := &Handler{store: s, logs: logstore.New(filepath.Join(dir, "logs"))}
+	projects := filepath.Join(dir, "projects")
+	if err := os.Mkdir(projects, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	h.opts.Store(&Options{ProjectsDir: projects})
+	return h, projects
+}
+
+func writeDefinition(t *testing.T, dir, id, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, id+projectfile.Suffix)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// actions maps the ids in a sync's results to their actions.
+func actions(results []syncResult) map[string]string {
+	out := map[string]string{}
+	for _, r := range results {
+		out[r.ID] = r.Action
+	}
+	return out
+}
+
+func TestSyncProjects(t *testing.T) {
+	h, dir := newSyncHandler(t)
+	h.store.PutProjectConfig(state.ProjectConfig{ID: "manual", Description: "made through the API"})
+	path := writeDefinition(t, dir, "api", "description: first\npipeline:\n  - name: build\n    cmd: make\n")
+	writeDefinition(t, dir, "web", "description: web\n")
+
+	got := actions(h.syncProjects())
+	if got["api"] != "created" || got["web"] != "created" || len(got) != 2 {
+		t.Fatalf("first sync = %v, want api and web created", got)
+	}
+	p, ok := h.store.GetProject("api")
+	if !ok || p.Description != "first" || p.Source != path || len(p.Pipeline) != 1 {
+		t.Fatalf("api = %+v, want the definition with its source", p)
+	}
+	h.store.UpdateRuntime("api", func(r *state.ProjectRuntime) { r.Status = "ACTIVE" })
+
+	if got := actions(h.syncProjects()); got["api"] != "unchanged" || got["web"] != "unchanged" {
+		t.Errorf("sync without changes = %v, want unchanged", got)
+	}
+
+	writeDefinition(t, dir, "api", "description: second\npipeline:\n  - name: build\n    cmd: make\n")
+	os.Remove(filepath.Join(dir, "web"+projectfile.Suffix))
+	results := h.syncProjects()
+	if got := actions(results); got["api"] != "updated" || got["web"] != "deleted" {
+		t.Fatalf("sync after changes = %v, want api updated and web deleted", got)
+	}
+	for _, r := range results {
+		if r.ID == "api" && (len(r.Fields) != 1 || r.Fields[0] != "description") {
+			t.Errorf("api changed fields = %v, want [description]", r.Fields)
+		}
+	}
+	if p, _ := h.store.GetProject("api"); p.Description != "second" || p.Status != "ACTIVE" {
+		t.Errorf("api = %q, %s, want the new description and the runtime state kept", p.Description, p.Status)
+	}
+	if _, ok := h.store.GetProject("web"); ok {
+		t.Error("web still exists after its definition was removed")
+	}
+	if _, ok := h.store.GetProject("manual"); !ok {
+		t.Error("project created through the API was deleted")
+	}
+}
+
+func TestSyncProjectsInvalid(t *testing.T) {
+	h, dir := newSyncHandler(t)
+	writeDefinition(t, dir, "", "description: x\n")
+	writeDefinition(t, dir, "tab\there", "description: x\n")
+	writeDefinition(t, dir, "typo", "descripton: x\n")
+	writeDefinition(t, dir, "other", "id: elsewhere\n")
+	writeDefinition(t, dir, "relative", "path: srv/app\n")
+	writeDefinition(t, dir, "ok", "description: fine\n")
+
+	results := h.syncProjects()
+	for _, r := range results {
+		want := "invalid"
+		if r.ID == "ok" {
+			want = "created"
+		}
+		if r.Action != want {
+			t.Errorf("%s: %s (%s), want %s", r.ID, r.Action, r.Error, want)
+		}
+		if r.Action == "invalid" && r.Error == "" {
+			t.Errorf("%s: invalid without a reason", r.ID)
+		}
+	}
+	if len(results) != 6 {
+		t.Errorf("got %d results, want 6", len(results))
+	}
+	if ps := h.store.GetProjects(); len(ps) != 1 || ps[0].ID != "ok" {
+		t.Errorf("projects = %v, want only ok", ps)
+	}
+}
+
+func TestSyncProjectsDependencyOrder(t *testing.T) {
+	h, dir := newSyncHandler(t)
+	// a sorts before b but depends on it
+	writeDefinition(t, dir, "a", "depends_on: [b]\n")
+	writeDefinition(t, dir, "b", "description: base\n")
+	if got := actions(h.syncProjects()); got["a"] != "created" || got["b"] != "created" {
+		t.Errorf("sync = %v, want both created", got)
+	}
+}
+
+func TestSyncProjectsKeptWhileRunning(t *testing.T) {
+	h, dir := newSyncHandler(t)
+	writeDefinition(t, dir, "api", "description: api\n")
+	h.syncProjects()
+
+	h.activeTasks.Store("api", &task{cancel: func() {}, done: make(chan struct{})})
+	os.Remove(filepath.Join(dir, "api"+projectfile.Suffix))
+	if got := actions(h.syncProjects()); got["api"] != "kept" {
+		t.Fatalf("sync while running = %v, want api kept", got)
+	}
+	if _, ok := h.store.GetProject("api"); !ok {
+		t.Fatal("running project was deleted")
+	}
+	if h.keptStopped() {
+		t.Error("keptStopped while the project still runs")
+	}
+
+	h.activeTasks.Delete("api")
+	if !h.keptStopped() {
+		t.Fatal("keptStopped is false once the project stopped, so the sync is not retried")
+	}
+	if got := actions(h.syncProjects()); got["api"] != "deleted" {
+		t.Errorf("retried sync = %v, want api deleted", got)
+	}
+	if h.keptStopped() {
+		t.Error("keptStopped after the retried sync")
+	}
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+const reloadCmdTimeout = 30 * time.Second
+
+var errNotRunning = errors.New("project is not running")
+
+// opLock returns the mutex serializing stop and restart of a project, so a
+// restart cannot interleave with another stop or restart.
+func (h *Handler) opLock(id string) *sync.Mutex {
+	mu, _ := h.projectOps.LoadOrStore(id, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// restartProject stops a project with its graceful stop sequence and starts
+// its pipeline again once everything has exited.
+func (h *Handler) restartProject(id string, trigger string) (string, error) {
+	mu := h.opLock(id)
+	mu.Lock()
+	defer mu.Unlock()
+	if err := h.stopProjectLocked(id); err != nil {
+		return "", err
+	}
+	return h.startProject(id, runOptions{Trigger: trigger})
+}
+
+// reloadProject asks a running project to reload its configuration: it
+// runs reload_cmd if set, otherwise sends reload_signal (default SIGHUP)
+// to the project's listening processes, or to its process groups when
+// none are found.
+func (h *Handler) reloadProject(id string) error {
+	p, ok := h.store.GetProject(id)
+	if !ok {
+		return errProjectNotFound
+	}
+	if p.ReloadCmd != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), reloadCmdTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", p.ReloadCmd)
+		cmd.Dir = p.Path
+		out, err := cmd.CombinedOutput()
+		msg := "\n===> Running reload_cmd\n" + string(out)
+		if err != nil {
+			msg += fmt.Sprintf("reload_cmd failed: %v\n", err)
+		}
+		h.store.UpdateRuntime(id, func(p *state.ProjectRuntime) { p.LastLog += msg })
+		if err != nil {
+			return fmt.Errorf("reload_cmd: %w", err)
+		}
+		return nil
+	}
+
+	sig, _ := parseSignal(p.ReloadSignal, syscall.SIGHUP)
+	groups, targets := h.projectProcesses(p)
+	if len(targets) == 0 {
+		for _, pgid := range groups {
+			targets = append(targets, -pgid)
+		}
+	}
+	if len(targets) == 0 {
+		return errNotRunning
+	}
+	for _, t := range targets {
+		if err := syscall.Kill(t, sig); err != nil {
+			log.Printf("reload %s: signal %d: %v", id, t, err)
+		}
+	}
+	h.store.UpdateRuntime(id, func(p *state.ProjectRuntime) {
+		p.LastLog += fmt.Sprintf("\n===> Sent %s to %d process(es)\n", signalName(sig), len(targets))
+	})
+	return nil
+}
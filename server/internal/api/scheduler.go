@@ -0,0 +1,152 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/schedule"
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// schedulerTick is how often the scheduler looks for due projects.
+const schedulerTick = 15 * time.Second
+
+// missedGrace is how late a run may be before it counts as missed (e.g. the
+// daemon or the Pi was down when it was due).
+const missedGrace = time.Minute
+
+// compileSchedule turns a project's schedule config into a schedule.Schedule.
+func compileSchedule(s *state.Schedule) (schedule.Schedule, error) {
+	switch {
+	case s.Cron != "" && s.Every != "":
+		return nil, errors.New("set either cron or every, not both")
+	case s.Cron != "":
+		return schedule.Parse(s.Cron, s.Timezone)
+	case s.Every != "":
+		return schedule.ParseInterval(s.Every)
+	}
+	return nil, errors.New("cron or every required")
+}
+
+// nextAfter returns the activation following prev, the one that just came
+// due, skipping any that passed before now. Intervals continue from prev
+// rather than from now, which lags it by up to a tick.
+func nextAfter(sched schedule.Schedule, prev, now time.Time) time.Time {
+	if i, ok := sched.(schedule.Interval); ok {
+		return i.After(prev, now)
+	}
+	return sched.Next(now)
+}
+
+// validateSchedule checks a schedule submitted through the API.
+func validateSchedule(s *state.Schedule) error {
+	if s == nil {
+		return nil
+	}
+	if s.Missed != "" && s.Missed != "skip" && s.Missed != "run" {
+		return errors.New(`missed must be "skip" or "run"`)
+	}
+	sched, err := compileSchedule(s)
+	if err != nil {
+		return err
+	}
+	if sched.Next(time.Now()).IsZero() {
+		return errors.New("cron expression never matches (e.g. February 30th)")
+	}
+	return nil
+}
+
+// runScheduler starts pipelines whose schedule is due. It keeps next_run up to
+// date in the store so the API can report it.
+func (h *Handler) runScheduler() {
+	// specs remembers the schedule each project had on the previous pass so a
+	// changed schedule gets a fresh next_run instead of the stale persisted one.
+	specs := map[string]state.Schedule{}
+
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	for {
+		h.schedulePass(specs, time.Now())
+		<-ticker.C
+	}
+}
+
+func (h *Handler) schedulePass(specs map[string]state.Schedule, now time.Time) {
+	seen := map[string]bool{}
+	for _, p := range h.store.GetProjects() {
+		if p.Schedule == nil || p.Schedule.Disabled {
+			if p.NextRun != nil {
+				h.store.UpdateRuntime(p.ID, func(p *state.ProjectRuntime) { p.NextRun = nil })
+			}
+			continue
+		}
+		seen[p.ID] = true
+		sched, err := compileSchedule(p.Schedule)
+		if err != nil {
+			log.Printf("scheduler: project %s: %v", p.ID, err)
+			continue
+		}
+
+		prev, known := specs[p.ID]
+		specs[p.ID] = *p.Schedule
+		if p.NextRun == nil || (known && prev != *p.Schedule) {
+			next := sched.Next(now)
+			if next.IsZero() {
+				// rejected when a schedule is saved, but state from older
+				// versions can hold one; say so once rather than every pass
+				if !known || prev != *p.Schedule {
+					log.Printf("scheduler: project %s: schedule never matches, not scheduling", p.ID)
+				}
+				if p.NextRun != nil {
+					h.store.UpdateRuntime(p.ID, func(p *state.ProjectRuntime) { p.NextRun = nil })
+				}
+				continue
+			}
+			h.store.UpdateRuntime(p.ID, func(p *state.ProjectRuntime) { p.NextRun = &next })
+			continue
+		}
+		if now.Before(*p.NextRun) {
+			continue
+		}
+
+		var next *time.Time
+		if t := nextAfter(sched, *p.NextRun, now); !t.IsZero() {
+			next = &t
+		} else {
+			log.Printf("scheduler: project %s: schedule never matches again, not scheduling", p.ID)
+		}
+		missed := now.Sub(*p.NextRun) > missedGrace
+		fire := !missed || p.Schedule.Missed == "run"
+		switch {
+		case !fire:
+			log.Printf("scheduler: project %s: skipping run missed at %s", p.ID, p.NextRun.Format(time.RFC3339))
+		case !h.options().AllowActions:
+			log.Printf("scheduler: project %s: actions disabled, not running", p.ID)
+			fire = false
+		default:
+			if _, running := h.activeTasks.Load(p.ID); running {
+				log.Printf("scheduler: project %s: previous run still active, skipping", p.ID)
+				fire = false
+			}
+		}
+
+		h.store.UpdateRuntime(p.ID, func(p *state.ProjectRuntime) {
+			p.NextRun = next
+			if fire {
+				p.LastScheduledRun = &now
+			}
+		})
+		if !fire {
+			continue
+		}
+		if _, err := h.startProject(p.ID, runOptions{Trigger: "schedule"}); err != nil {
+			log.Printf("scheduler: project %s: %v", p.ID, err)
+		}
+	}
+	for id := range specs {
+		if !seen[id] {
+			delete(specs, id)
+		}
+	}
+}
@@ -2,9 +2,9 @@ package api
 
 import (
 	"bufio"
-	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
 	"log"
@@ -16,9 +16,14 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/davidrocha/pi-manager/internal/audit"
+	"github.com/davidrocha/pi-manager/internal/fsjail"
+	"github.com/davidrocha/pi-manager/internal/git"
+	"github.com/davidrocha/pi-manager/internal/logstore"
 	"github.com/davidrocha/pi-manager/internal/state"
 	"github.com/davidrocha/pi-manager/internal/systemd"
 )
@@ -27,31 +32,84 @@ import (
 var webFS embed.FS
 
 type Handler struct {
-	store        *state.Store
-	sd           *systemd.Client
-	startTime    time.Time
-	allowActions bool
-	mux          *http.ServeMux
-	fsBase       string
-	activeTasks  sync.Map // map[string]context.CancelFunc
-}
-
-func NewHandler(s *state.Store, sd *systemd.Client, start time.Time, allowActions bool, fsBase string) http.Handler {
-	if fsBase == "" {
-		fsBase = "/"
+	store       *state.Store
+	sd          *systemd.Client
+	startTime   time.Time
+	opts        atomic.Pointer[Options]
+	mux         *http.ServeMux
+	activeTasks sync.Map // map[string]*task
+	projectOps  sync.Map // map[string]*sync.Mutex, serializes stop and restart
+	procs       procTracker
+	logs        *logstore.Store
+	audit       *audit.Logger
+	stdins      sync.Map // map[string]*os.File, stdin of the running step of interactive projects
+	sync        projectSync
+}
+
+// Options are the daemon settings the handler depends on. All but
+// RestoreRunning, which only matters on startup, can be changed at runtime
+// with Reconfigure.
+type Options struct {
+	AllowActions   bool
+	AllowTerminal  bool
+	RestoreRunning bool
+	Jail           *fsjail.Jail
+	HealthInterval time.Duration
+	ProjectsDir    string // directory of *.project.yaml definitions; empty disables syncing
+}
+
+// NewHandler builds the API handler. Statuses loaded from the snapshot are
+// reconciled first; projects with autostart (and, with RestoreRunning, those
+// that were running before) are then started in the background.
+func NewHandler(s *state.Store, sd *systemd.Client, start time.Time, opts Options) *Handler {
+	h := &Handler{store: s, sd: sd, startTime: start, mux: http.NewServeMux()}
+	h.opts.Store(&opts)
+	h.logs = logstore.New(filepath.Join(s.DataDir(), "logs"))
+	h.audit = audit.New(filepath.Join(s.DataDir(), "audit.log"))
+	h.procs.save = func(id string, pgids []int) {
+		s.UpdateRuntime(id, func(r *state.ProjectRuntime) { r.ProcessGroups = pgids })
 	}
-	fsBase = filepath.Clean(fsBase)
-	h := &Handler{store: s, sd: sd, startTime: start, allowActions: allowActions, mux: http.NewServeMux(), fsBase: fsBase}
 	h.routes()
+	interrupted := h.reconcile()
+	h.syncProjects()
+	go h.watchProjects()
+	if !opts.RestoreRunning {
+		interrupted = nil
+	}
+	go h.autostart(interrupted)
 	go h.backgroundHealthCollection()
+	go h.runScheduler()
 	return h
 }
 
+// options returns the current settings.
+func (h *Handler) options() *Options {
+	return h.opts.Load()
+}
+
+// Reconfigure replaces the settings. Requests already being served keep
+// the settings they started with.
+func (h *Handler) Reconfigure(opts Options) {
+	h.opts.Store(&opts)
+}
+
 func (h *Handler) routes() {
 	h.mux.HandleFunc("/api/v1/", h.handleRoot)
 	h.mux.HandleFunc("/api/v1/projects", h.handleProjects)
 	h.mux.HandleFunc("/api/v1/projects/", h.handleProjectAction)
+	h.mux.HandleFunc("/api/v1/logs/search", h.handleLogSearch)
+	h.mux.HandleFunc("/api/v1/groups", h.handleGroups)
+	h.mux.HandleFunc("/api/v1/groups/", h.handleGroupAction)
+	h.mux.HandleFunc("/api/v1/templates", h.handleTemplates)
+	h.mux.HandleFunc("/api/v1/templates/", h.handleTemplate)
+	h.mux.HandleFunc("/api/v1/hooks", h.handleHooks)
+	h.mux.HandleFunc("/api/v1/hooks/", h.handleHook)
 	h.mux.HandleFunc("/api/v1/fs", h.handleFS)
+	h.mux.HandleFunc("/api/v1/config/projects", h.handleProjectConfig)
+	h.mux.HandleFunc("/api/v1/config/projects/", h.handleProjectConfig)
+	h.mux.HandleFunc("/api/v1/fs/", h.handleFSAction)
+	h.mux.HandleFunc("/api/v1/backup", h.handleBackup)
+	h.mux.HandleFunc("/api/v1/restore", h.handleRestore)
 	h.mux.HandleFunc("/api/v1/health", h.handleHealth)
 	h.mux.HandleFunc("/api/v1/pi-health", h.handlePiHealth)
 	h.mux.HandleFunc("/api/v1/boots/last", h.handleBootsLast)
@@ -59,62 +117,6 @@ func (h *Handler) routes() {
 	h.mux.HandleFunc("/", h.handleStatic)
 }
 
-// handleFS lists directories/files under the server-configured base path.
-// Query param: ?path=relative/path (optional). Response: [{name, path, is_dir}]
-func (h *Handler) handleFS(w http.ResponseWriter, r *http.Request) {
-	qp := r.URL.Query().Get("path")
-	// sanitize and resolve
-	tgt := filepath.Join(h.fsBase, qp)
-	tgt = filepath.Clean(tgt)
-	// ensure tgt is within fsBase
-	if !strings.HasPrefix(tgt, h.fsBase) {
-		w.WriteHeader(http.StatusForbidden)
-		writeJSON(w, map[string]string{"error": "path outside allowed base"})
-		return
-	}
-	info, err := os.Stat(tgt)
-	if err != nil || !info.IsDir() {
-		w.WriteHeader(http.StatusNotFound)
-		writeJSON(w, map[string]string{"error": "not found or not a directory"})
-		return
-	}
-	entries, err := os.ReadDir(tgt)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		writeJSON(w, map[string]string{"error": err.Error()})
-		return
-	}
-	out := make([]map[string]interface{}, 0, len(entries))
-	for _, e := range entries {
-		// Only show directories
-		if !e.IsDir() {
-			continue
-		}
-
-		// Hide dot-folders and specific noise folders
-		name := e.Name()
-		if strings.HasPrefix(name, ".") ||
-			name == "go" ||
-			name == "snap" ||
-			name == "node_modules" {
-			continue
-		}
-
-		full := filepath.Join(tgt, name)
-		rel, _ := filepath.Rel(h.fsBase, full)
-		out = append(out, map[string]interface{}{
-			"name":     name,
-			"path":     rel,
-			"abs_path": full,
-			"is_dir":   true,
-		})
-	}
-	writeJSON(w, map[string]interface{}{
-		"current_path": tgt,
-		"entries":      out,
-	})
-}
-
 func (h *Handler) handleStatic(w http.ResponseWriter, r *http.Request) {
 	// Root sub-filesystem for the "web" directory
 	web, err := fs.Sub(webFS, "web")
@@ -165,38 +167,17 @@ func (h *Handler) handleRoot(w http.ResponseWriter, r *http.Request) {
 
 // no service/unit endpoints — UI manages projects only
 
-// handleProjects supports GET to list and POST to create a project
-func (h *Handler) handleProjects(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		ps := h.store.GetProjects()
-		writeJSON(w, ps)
-		return
-	case http.MethodPost:
-		var p state.Project
-		dec := json.NewDecoder(r.Body)
-		if err := dec.Decode(&p); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			writeJSON(w, map[string]string{"error": "invalid json"})
-			return
-		}
-		if p.ID == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			writeJSON(w, map[string]string{"error": "id required"})
-			return
-		}
-		if p.Status == "" {
-			p.Status = "IDLE"
-		}
-		h.store.AddProject(p)
-		if err := h.store.Snapshot(); err != nil {
-			log.Printf("snapshot error: %v", err)
-		}
-		writeJSON(w, p)
-		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+// deleteProject stops a project and removes it with its runs, artifacts
+// and logs.
+func (h *Handler) deleteProject(id string) {
+	h.killProject(id)
+	h.store.RemoveProject(id)
+	if err := RemoveArtifacts(h.store.DataDir(), id); err != nil {
+		log.Printf("removing artifacts of %s: %v", id, err)
+	}
+	h.logs.RemoveProject(id)
+	if err := h.store.Snapshot(); err != nil {
+		log.Printf("snapshot error: %v", err)
 	}
 }
 
@@ -225,181 +206,177 @@ func (h *Handler) handleProjectAction(w http.ResponseWriter, r *http.Request) {
 	}
 	switch r.Method {
 	case http.MethodGet:
+		switch action {
+		case "git":
+			h.handleProjectGit(w, r, id)
+			return
+		case "logs":
+			h.handleProjectLogs(w, r, id)
+			return
+		case "terminal":
+			h.handleTerminal(w, r, id)
+			return
+		case "pipeline":
+			p, ok := h.store.GetProject(id)
+			if !ok {
+				h.wNotFound(w)
+				return
+			}
+			steps, err := h.resolvePipeline(p)
+			if err != nil {
+				w.WriteHeader(http.StatusConflict)
+				writeJSON(w, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, steps)
+			return
+		case "runs":
+			if _, ok := h.store.GetProject(id); !ok {
+				h.wNotFound(w)
+				return
+			}
+			writeJSON(w, h.store.GetRuns(id))
+			return
+		}
+		if strings.HasPrefix(action, "runs/") {
+			h.handleRun(w, r, id, strings.TrimPrefix(action, "runs/"))
+			return
+		}
 		if p, ok := h.store.GetProject(id); ok {
+			setETag(w, p)
 			writeJSON(w, p)
 			return
 		}
 		h.wNotFound(w)
 		return
-	case http.MethodDelete:
-		h.killProject(id)
-		h.store.RemoveProject(id)
-		if err := h.store.Snapshot(); err != nil {
-			log.Printf("snapshot error: %v", err)
+	case http.MethodPut, http.MethodPatch:
+		if action != "" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
+		h.updateProject(w, r, id)
+		return
+	case http.MethodDelete:
+		h.deleteProject(id)
 		w.WriteHeader(http.StatusNoContent)
 		return
 	case http.MethodPost:
-		if action == "start" {
-			if !h.allowActions {
+		if action == "start" || action == "deploy" || action == "restart" || action == "reload" {
+			if !h.options().AllowActions {
 				w.WriteHeader(http.StatusForbidden)
 				writeJSON(w, map[string]string{"error": "actions disabled"})
 				return
 			}
-			p, ok := h.store.GetProject(id)
-			if !ok {
-				h.wNotFound(w)
-				return
-			}
-
-			if p.Status == "RUNNING" {
-				writeJSON(w, map[string]string{"error": "project already running"})
+			if action == "reload" {
+				switch err := h.reloadProject(id); err {
+				case nil:
+					writeJSON(w, map[string]string{"status": "reloaded"})
+				case errProjectNotFound:
+					h.wNotFound(w)
+				case errNotRunning:
+					w.WriteHeader(http.StatusConflict)
+					writeJSON(w, map[string]string{"error": err.Error()})
+				default:
+					w.WriteHeader(http.StatusInternalServerError)
+					writeJSON(w, map[string]string{"error": err.Error()})
+				}
 				return
 			}
-
-			// Run in background
-			ctx, cancel := context.WithCancel(context.Background())
-			h.activeTasks.Store(id, cancel)
-
-			go func(proj state.Project) {
-				defer h.activeTasks.Delete(id)
-				defer cancel()
-
-				proj.Status = "BOOTING"
-				proj.LastLog = ""
-				proj.Progress = 0
-				h.store.AddProject(proj) // Update status to BOOTING
-
-				var combinedOutput strings.Builder
-				var finalErr error
-				var projLock sync.Mutex
-				totalSteps := len(proj.Pipeline)
-
-				for i, step := range proj.Pipeline {
-					if ctx.Err() != nil {
-						finalErr = ctx.Err()
-						break
-					}
-
-					projLock.Lock()
-					proj.CurrentStep = step.Name
-					// Progress: if we have 3 steps, they should be 33, 66, 100
-					proj.Progress = (i + 1) * 100 / totalSteps
-					h.store.AddProject(proj)
-
-					combinedOutput.WriteString(fmt.Sprintf("===> [%d/%d] Running Step: %s\n", i+1, totalSteps, step.Name))
-					proj.LastLog = combinedOutput.String()
-					h.store.AddProject(proj)
-					projLock.Unlock()
-
-					cmdStr := step.Cmd
-					if strings.Contains(cmdStr, "boot.sh") || strings.Contains(cmdStr, "dev.sh") {
-						cmdStr = "tailscale up && " + cmdStr
-					}
-
-					cmd := exec.CommandContext(ctx, "sh", "-c", cmdStr)
-					if proj.Path != "" {
-						cmd.Dir = proj.Path
+			opts := runOptions{Trigger: "manual"}
+			partial := r.URL.Query().Get("from_step") != "" || r.URL.Query().Get("only_step") != ""
+			if action == "start" && !partial && r.URL.Query().Get("deps") != "false" {
+				if p, ok := h.store.GetProject(id); ok && len(p.DependsOn) > 0 {
+					if _, running := h.activeTasks.Load(id); running {
+						w.WriteHeader(http.StatusConflict)
+						writeJSON(w, map[string]string{"error": "project already running"})
+						return
 					}
-					// Set process group so we can kill children (like dev servers)
-					cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-					// Use a writer that updates the store in real-time
-					writer := &logWriter{
-						h:        h,
-						proj:     &proj,
-						projLock: &projLock,
-						build:    &combinedOutput,
+					order, err := dependencyOrder(h.projectMap(), []string{id})
+					if err != nil {
+						w.WriteHeader(http.StatusConflict)
+						writeJSON(w, map[string]string{"error": err.Error()})
+						return
 					}
-					cmd.Stdout = writer
-					cmd.Stderr = writer
-
-					if err := cmd.Start(); err != nil {
-						combinedOutput.WriteString(fmt.Sprintf("Failed to start: %v\n", err))
-						finalErr = err
-						break
-					}
-
-					// Attempt auto-discovery of ports
-					go func(pid int) {
-						// Wait a moment for process to establish PGID
-						time.Sleep(500 * time.Millisecond)
-						pgid, err := syscall.Getpgid(pid)
-						if err != nil {
-							pgid = pid // fallback
-						}
-
-						// Try multiple times over a few seconds
-						for i := 0; i < 30; i++ {
-							time.Sleep(1 * time.Second)
-							ports := findPortsForPGID(pgid)
-							if len(ports) > 0 {
-								projLock.Lock()
-								// Update if ports list changed, regardless of status (active services might persist after boot script)
-								if !slicesEqual(proj.Ports, ports) {
-									proj.Ports = ports
-									h.store.AddProject(proj)
-								}
-								projLock.Unlock()
-							}
-						}
-					}(cmd.Process.Pid)
-
-					// Helper to kill the entire process group if context is cancelled
-					go func() {
-						<-ctx.Done()
-						if cmd.Process != nil {
-							pgid, err := syscall.Getpgid(cmd.Process.Pid)
-							if err == nil {
-								syscall.Kill(-pgid, syscall.SIGKILL)
-							}
-						}
-					}()
-
-					finalErr = cmd.Wait()
-					if finalErr != nil {
-						combinedOutput.WriteString(fmt.Sprintf("\nERROR in step '%s': %v\n", step.Name, finalErr))
-						break
+					go h.startOrdered(order, "manual")
+					writeJSON(w, map[string]interface{}{"status": "starting", "order": order})
+					return
+				}
+			}
+			if action == "deploy" {
+				opts = runOptions{Trigger: "deploy", Deploy: true, Ref: r.URL.Query().Get("ref")}
+				var body struct {
+					Ref string `json:"ref"`
+				}
+				if r.ContentLength > 0 {
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						writeJSON(w, map[string]string{"error": "invalid json"})
+						return
 					}
-					combinedOutput.WriteString("\n")
 				}
-
-				projLock.Lock()
-				proj.CurrentStep = ""
-				if finalErr != nil {
-					// Check if context was canceled or if task was removed from active map (user stop)
-					_, isActive := h.activeTasks.Load(id)
-					if finalErr == context.Canceled || ctx.Err() == context.Canceled || !isActive {
-						proj.Status = "IDLE"
-						combinedOutput.WriteString("\nStopped by user.\n")
-					} else {
-						proj.Status = "FAILED"
+				if body.Ref != "" {
+					opts.Ref = body.Ref
+				}
+				if opts.Ref != "" {
+					if err := git.ValidRef(opts.Ref); err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						writeJSON(w, map[string]string{"error": err.Error()})
+						return
 					}
-				} else {
-					proj.Status = "ACTIVE"
 				}
-				proj.LastLog = combinedOutput.String()
-				h.store.AddProject(proj)
-				h.store.Snapshot()
-				projLock.Unlock()
-			}(p)
+			}
+			opts.FromStep = r.URL.Query().Get("from_step")
+			opts.OnlyStep = r.URL.Query().Get("only_step")
+			var runID string
+			var err error
+			if action == "restart" && partial {
+				w.WriteHeader(http.StatusBadRequest)
+				writeJSON(w, map[string]string{"error": "restart runs the whole pipeline; use start with from_step or only_step"})
+				return
+			}
+			if action == "restart" {
+				runID, err = h.restartProject(id, "restart")
+			} else {
+				runID, err = h.startProject(id, opts)
+			}
+			switch err {
+			case nil:
+			case errProjectNotFound:
+				h.wNotFound(w)
+				return
+			case errAlreadyRunning:
+				w.WriteHeader(http.StatusConflict)
+				writeJSON(w, map[string]string{"error": "project already running"})
+				return
+			default:
+				if errors.Is(err, errBadStepSelection) {
+					w.WriteHeader(http.StatusBadRequest)
+					writeJSON(w, map[string]string{"error": err.Error()})
+					return
+				}
+				if errors.Is(err, errBadPipeline) {
+					w.WriteHeader(http.StatusConflict)
+					writeJSON(w, map[string]string{"error": err.Error()})
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				writeJSON(w, map[string]string{"error": err.Error()})
+				return
+			}
 
-			writeJSON(w, map[string]string{"status": "started"})
+			status := "started"
+			if action == "restart" {
+				status = "restarted"
+			}
+			writeJSON(w, map[string]string{"status": status, "run": runID})
 			return
 		}
 
 		if action == "stop" {
-			h.killProject(id)
-			p, ok := h.store.GetProject(id)
-			if !ok {
+			if err := h.stopProject(id); err != nil {
 				h.wNotFound(w)
 				return
 			}
-
-			p.Status = "IDLE"
-			p.Progress = 0
-			p.CurrentStep = ""
-			h.store.AddProject(p)
 			writeJSON(w, map[string]string{"status": "stopped"})
 			return
 		}
@@ -426,33 +403,23 @@ func (h *Handler) handlePiHealth(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, result)
 }
 
-func (h *Handler) killProject(id string) {
-	if cancel, ok := h.activeTasks.Load(id); ok {
-		cancel.(context.CancelFunc)()
-		h.activeTasks.Delete(id)
-	}
-
-	if p, ok := h.store.GetProject(id); ok {
-		// If project has ports defined, try to kill whatever is using them
-		for _, port := range p.Ports {
-			// We use lsof -ti:PORT to find PIDs and kill them
-			exec.Command("sh", "-c", fmt.Sprintf("lsof -ti:%s | xargs kill -9", port)).Run()
-		}
-	}
-}
-
 func (h *Handler) backgroundHealthCollection() {
 	// Take initial snapshot immediately
 	stats := h.collectPiHealthStats()
 	h.store.AddPiHealthStat(stats)
 
-	ticker := time.NewTicker(60 * time.Second)
+	interval := h.options().HealthInterval
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		<-ticker.C
 		stats := h.collectPiHealthStats()
 		h.store.AddPiHealthStat(stats)
+		if d := h.options().HealthInterval; d != interval {
+			interval = d
+			ticker.Reset(d)
+		}
 	}
 }
 
@@ -688,16 +655,27 @@ type logWriter struct {
 	h        *Handler
 	proj     *state.Project
 	projLock *sync.Mutex
-	build    *strings.Builder
+	log      *logstore.Log
+	lines    *logstore.LineWriter
 }
 
 func (lw *logWriter) Write(p []byte) (n int, err error) {
+	lw.lines.Write(p)
+	lw.publish()
+	return len(p), nil
+}
+
+// Flush stores a trailing partial line.
+func (lw *logWriter) Flush() {
+	lw.lines.Flush()
+	lw.publish()
+}
+
+func (lw *logWriter) publish() {
 	lw.projLock.Lock()
 	defer lw.projLock.Unlock()
-	lw.build.Write(p)
-	lw.proj.LastLog = lw.build.String()
-	lw.h.store.AddProject(*lw.proj)
-	return len(p), nil
+	lw.proj.LastLog = lw.log.Tail()
+	lw.h.store.UpdateRuntime(lw.proj.ID, func(r *state.ProjectRuntime) { r.LastLog = lw.proj.LastLog })
 }
 
 // findPortsForPGID attempts to find all TCP listening ports for a process group
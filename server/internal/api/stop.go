@@ -0,0 +1,314 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+const (
+	defaultStopTimeout = 10 * time.Second
+	stopPollInterval   = 100 * time.Millisecond
+)
+
+// procTracker remembers the process groups started for each project, so
+// processes a step left running in the background can still be stopped
+// after the step itself has finished. Changes are passed to save, which
+// records them in the project's runtime state so they are still known
+// after the daemon restarted.
+type procTracker struct {
+	mu     sync.Mutex
+	groups map[string]map[int]bool // project id -> pgids
+	save   func(project string, pgids []int)
+}
+
+func (t *procTracker) add(project string, pgid int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.groups == nil {
+		t.groups = map[string]map[int]bool{}
+	}
+	if t.groups[project] == nil {
+		t.groups[project] = map[int]bool{}
+	}
+	t.groups[project][pgid] = true
+	t.saveLocked(project)
+}
+
+// restore adopts the process groups recorded for a project by a previous
+// daemon, keeping those that still have members.
+func (t *procTracker) restore(project string, pgids []int) {
+	for _, pgid := range pgids {
+		if len(collectProcessGroup(pgid)) > 0 {
+			t.add(project, pgid)
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.saveLocked(project)
+}
+
+// list returns the project's process groups that still have members.
+func (t *procTracker) list(project string) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []int
+	gone := false
+	for pgid := range t.groups[project] {
+		if syscall.Kill(-pgid, 0) == nil {
+			out = append(out, pgid)
+		} else {
+			delete(t.groups[project], pgid)
+			gone = true
+		}
+	}
+	if gone {
+		t.saveLocked(project)
+	}
+	sort.Ints(out)
+	return out
+}
+
+func (t *procTracker) forget(project string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.groups, project)
+	t.saveLocked(project)
+}
+
+// saveLocked passes the project's groups to save. t.mu must be held.
+func (t *procTracker) saveLocked(project string) {
+	if t.save == nil {
+		return
+	}
+	var pgids []int
+	for pgid := range t.groups[project] {
+		pgids = append(pgids, pgid)
+	}
+	sort.Ints(pgids)
+	t.save(project, pgids)
+}
+
+var signalNames = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// signalName returns the conventional name of sig, e.g. "SIGHUP".
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return name
+		}
+	}
+	return fmt.Sprintf("signal %d", int(sig))
+}
+
+// parseSignal accepts names such as "SIGTERM" or "term". An empty name
+// yields def.
+func parseSignal(name string, def syscall.Signal) (syscall.Signal, error) {
+	if name == "" {
+		return def, nil
+	}
+	n := strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(n, "SIG") {
+		n = "SIG" + n
+	}
+	sig, ok := signalNames[n]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %q", name)
+	}
+	return sig, nil
+}
+
+// stopSettings returns the signal a project's processes are asked to stop
+// with and how long they get before being killed.
+func stopSettings(p state.Project) (syscall.Signal, time.Duration) {
+	sig, err := parseSignal(p.StopSignal, syscall.SIGTERM)
+	if err != nil {
+		sig = syscall.SIGTERM
+	}
+	timeout := defaultStopTimeout
+	if d, err := time.ParseDuration(p.StopTimeout); err == nil && d >= 0 {
+		timeout = d
+	}
+	return sig, timeout
+}
+
+// terminate sends sig to targets (PIDs, or negated PGIDs for whole groups),
+// waits up to timeout for them to exit and SIGKILLs whatever is left. It
+// reports the targets that had to be killed.
+func terminate(targets []int, sig syscall.Signal, timeout time.Duration) []int {
+	var alive []int
+	for _, t := range targets {
+		if syscall.Kill(t, sig) == nil {
+			alive = append(alive, t)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for len(alive) > 0 && time.Now().Before(deadline) {
+		time.Sleep(stopPollInterval)
+		remaining := alive[:0]
+		for _, t := range alive {
+			if syscall.Kill(t, 0) == nil {
+				remaining = append(remaining, t)
+			}
+		}
+		alive = remaining
+	}
+	for _, t := range alive {
+		syscall.Kill(t, syscall.SIGKILL)
+	}
+	return alive
+}
+
+// killProject stops everything a project runs: its stop_cmd first, then the
+// pipeline and every process group it started, then processes of the
+// project still listening on one of its ports. Processes receive
+// stop_signal and have stop_timeout to exit before they are killed.
+// stop_cmd is a command like any other, so it only runs with
+// --allow-actions; without, stopping relies on the signals alone.
+func (h *Handler) killProject(id string) {
+	p, ok := h.store.GetProject(id)
+	if ok && p.StopCmd != "" {
+		if h.options().AllowActions {
+			h.runStopCmd(p)
+		} else {
+			log.Printf("stop %s: actions disabled, not running stop_cmd", id)
+		}
+	}
+
+	var running *task
+	if t, ok := h.activeTasks.Load(id); ok {
+		running = t.(*task)
+		running.cancel()
+	}
+	if !ok {
+		return
+	}
+
+	sig, timeout := stopSettings(p)
+	groups, listeners := h.projectProcesses(p)
+	targets := listeners
+	for _, pgid := range groups {
+		targets = append(targets, -pgid)
+	}
+	if killed := terminate(targets, sig, timeout); len(killed) > 0 {
+		log.Printf("stop %s: %d process(es) did not exit within %s and were killed", id, len(killed), timeout)
+	}
+	if running != nil {
+		// the pipeline records its final status once its steps have exited
+		select {
+		case <-running.done:
+		case <-time.After(timeout + time.Second):
+			log.Printf("stop %s: pipeline did not finish", id)
+		}
+	}
+	h.procs.forget(id)
+}
+
+// projectProcesses returns the process groups the project started that are
+// still alive, and the processes of the project listening on its ports.
+func (h *Handler) projectProcesses(p state.Project) (groups, listeners []int) {
+	groups = h.procs.list(p.ID)
+	for _, port := range p.AllPorts() {
+		for _, pid := range listenerPIDs(port) {
+			if ownedBy(pid, groups) {
+				listeners = append(listeners, pid)
+			}
+		}
+	}
+	return groups, listeners
+}
+
+// runStopCmd runs a project's stop_cmd and appends its output to the log.
+func (h *Handler) runStopCmd(p state.Project) {
+	_, timeout := stopSettings(p)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", p.StopCmd)
+	cmd.Dir = p.Path
+	out, err := cmd.CombinedOutput()
+	msg := "\n===> Running stop_cmd\n" + string(out)
+	if err != nil {
+		msg += fmt.Sprintf("stop_cmd failed: %v\n", err)
+		log.Printf("stop %s: stop_cmd: %v", p.ID, err)
+	}
+	h.store.UpdateRuntime(p.ID, func(p *state.ProjectRuntime) { p.LastLog += msg })
+}
+
+// listenerPIDs returns the processes holding a listening socket on port.
+func listenerPIDs(port string) []int {
+	inodes := map[uint64]bool{}
+	for inode, p := range parseNetTCP() {
+		if p == port {
+			inodes[inode] = true
+		}
+	}
+	if len(inodes) == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fdPath := filepath.Join("/proc", entry.Name(), "fd")
+		fds, err := os.ReadDir(fdPath)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdPath, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err == nil && inodes[inode] {
+				pids = append(pids, pid)
+				break
+			}
+		}
+	}
+	return pids
+}
+
+// ownedBy reports whether pid belongs to the project, that is whether it is
+// in one of the project's process groups. Where a process runs says nothing
+// about who started it, so nothing else counts.
+func ownedBy(pid int, groups []int) bool {
+	if pid == os.Getpid() {
+		return false
+	}
+	pgid, err := syscall.Getpgid(pid)
+	if err != nil {
+		return false
+	}
+	for _, g := range groups {
+		if g == pgid {
+			return true
+		}
+	}
+	return false
+}
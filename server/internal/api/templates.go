@@ -0,0 +1,234 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// resolvePipeline returns the steps a project actually runs. Without a
+// template that is its own pipeline. With one, the template's steps are
+// expanded with the project's parameters; project steps replace template
+// steps of the same name and any others are appended.
+func (h *Handler) resolvePipeline(p state.Project) ([]state.PipelineStep, error) {
+	return expandTemplate(p, h.store.GetTemplate)
+}
+
+// expandTemplate is resolvePipeline with templates looked up by lookup.
+func expandTemplate(p state.Project, lookup func(id string) (state.Template, bool)) ([]state.PipelineStep, error) {
+	if p.Template == "" {
+		return p.Pipeline, nil
+	}
+	t, ok := lookup(p.Template)
+	if !ok {
+		return nil, fmt.Errorf("template %q not found", p.Template)
+	}
+
+	data := map[string]string{
+		"ID":     p.ID,
+		"Path":   p.Path,
+		"Repo":   p.Repo,
+		"Branch": p.Branch,
+		"Port":   "",
+	}
+	if len(p.Ports) > 0 {
+		data["Port"] = p.Ports[0]
+	}
+	for k, v := range t.Params {
+		data[k] = v
+	}
+	for k, v := range p.TemplateParams {
+		data[k] = v
+	}
+
+	overrides := map[string]state.PipelineStep{}
+	for _, st := range p.Pipeline {
+		overrides[st.Name] = st
+	}
+	steps := make([]state.PipelineStep, 0, len(t.Pipeline)+len(p.Pipeline))
+	used := map[string]bool{}
+	for _, st := range t.Pipeline {
+		if o, ok := overrides[st.Name]; ok {
+			steps = append(steps, o)
+			used[st.Name] = true
+			continue
+		}
+		var err error
+		for _, field := range []*string{&st.Cmd, &st.WorkingDir, &st.When} {
+			if *field, err = expandParam(*field, data); err != nil {
+				return nil, fmt.Errorf("template %s, step %s: %w", t.ID, st.Name, err)
+			}
+		}
+		steps = append(steps, st)
+	}
+	for _, st := range p.Pipeline {
+		if !used[st.Name] {
+			steps = append(steps, st)
+		}
+	}
+	return steps, nil
+}
+
+func expandParam(s string, data map[string]string) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	tmpl, err := template.New("").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// handleTemplates lists (GET) and creates (POST) pipeline templates.
+func (h *Handler) handleTemplates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, h.store.GetTemplates())
+	case http.MethodPost:
+		var t state.Template
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid json"})
+			return
+		}
+		if _, exists := h.store.GetTemplate(t.ID); exists {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]string{"error": "template already exists"})
+			return
+		}
+		h.saveTemplate(w, t)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTemplate reads (GET), replaces (PUT) or deletes (DELETE) a template.
+// Changes apply to every project using the template on its next run.
+func (h *Handler) handleTemplate(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/templates/")
+	if id == "" {
+		h.handleTemplates(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		t, ok := h.store.GetTemplate(id)
+		if !ok {
+			h.wNotFound(w)
+			return
+		}
+		writeJSON(w, t)
+	case http.MethodPut:
+		var t state.Template
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid json"})
+			return
+		}
+		t.ID = id
+		h.saveTemplate(w, t)
+	case http.MethodDelete:
+		if _, ok := h.store.GetTemplate(id); !ok {
+			h.wNotFound(w)
+			return
+		}
+		var users []string
+		for _, p := range h.store.GetProjects() {
+			if p.Template == id {
+				users = append(users, p.ID)
+			}
+		}
+		if len(users) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]interface{}{"error": "template in use", "projects": users})
+			return
+		}
+		h.store.RemoveTemplate(id)
+		if err := h.store.Snapshot(); err != nil {
+			log.Printf("snapshot error: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) saveTemplate(w http.ResponseWriter, t state.Template) {
+	if err := validateTemplate(t); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": err.Error()})
+		return
+	}
+	if broken := h.brokenByTemplate(t); len(broken) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		writeJSON(w, map[string]interface{}{"error": "template would break projects using it", "projects": broken})
+		return
+	}
+	h.store.AddTemplate(t)
+	if err := h.store.Snapshot(); err != nil {
+		log.Printf("snapshot error: %v", err)
+	}
+	writeJSON(w, t)
+}
+
+// templateUser is a project whose pipeline a template change would break.
+type templateUser struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// brokenByTemplate resolves the pipelines of the projects using t as they
+// would be with t stored, and returns those that would not be valid.
+func (h *Handler) brokenByTemplate(t state.Template) []templateUser {
+	lookup := func(id string) (state.Template, bool) {
+		if id == t.ID {
+			return t, true
+		}
+		return h.store.GetTemplate(id)
+	}
+	var broken []templateUser
+	for _, p := range h.store.GetProjects() {
+		if p.Template != t.ID {
+			continue
+		}
+		steps, err := expandTemplate(p, lookup)
+		if err == nil {
+			err = validatePipeline(steps)
+		}
+		if err != nil {
+			broken = append(broken, templateUser{ID: p.ID, Error: err.Error()})
+		}
+	}
+	return broken
+}
+
+// validateTemplate checks a template on its own, without the projects
+// using it.
+func validateTemplate(t state.Template) error {
+	if t.ID == "" || strings.Contains(t.ID, "/") {
+		return errors.New("valid id required")
+	}
+	if err := validatePipeline(t.Pipeline); err != nil {
+		return fmt.Errorf("invalid pipeline: %w", err)
+	}
+	for _, st := range t.Pipeline {
+		for _, field := range []string{st.Cmd, st.WorkingDir, st.When} {
+			if _, err := template.New("").Parse(field); err != nil {
+				return fmt.Errorf("step %s: %v", st.Name, err)
+			}
+		}
+	}
+	return nil
+}
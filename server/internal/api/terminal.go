@@ -0,0 +1,342 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+
+	"github.com/davidrocha/pi-manager/internal/audit"
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+const (
+	terminalCloseGrace = 2 * time.Second
+	attachPollInterval = 500 * time.Millisecond
+	maxAuditInputLine  = 1024
+)
+
+// The default origin check rejects cross-site requests, so other web pages
+// cannot open terminals with the user's network access to the Pi.
+var upgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+// termMessage is a message from the terminal client.
+type termMessage struct {
+	Type string `json:"type"` // "input" or "resize"
+	Data string `json:"data,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+}
+
+// termSession is an open terminal. Everything the client types is recorded
+// in the audit log line by line, and the output in a session recording.
+type termSession struct {
+	h       *Handler
+	id      string
+	project string
+	remote  string
+	conn    *websocket.Conn
+	rec     *os.File
+
+	mu    sync.Mutex // guards input
+	input []byte
+}
+
+// handleTerminal serves GET /api/v1/projects/{id}/terminal as a WebSocket.
+// By default it opens a shell on a PTY in the project path; with
+// ?mode=attach it connects to the stdin and output of the project's running
+// pipeline step (interactive projects only). Requires --allow-actions and
+// --allow-terminal.
+//
+// Clients send JSON messages {"type":"input","data":"ls\r"} and
+// {"type":"resize","cols":120,"rows":40}; output arrives as binary messages.
+func (h *Handler) handleTerminal(w http.ResponseWriter, r *http.Request, id string) {
+	if !h.options().AllowActions || !h.options().AllowTerminal {
+		w.WriteHeader(http.StatusForbidden)
+		writeJSON(w, map[string]string{"error": "terminal disabled"})
+		return
+	}
+	p, ok := h.store.GetProject(id)
+	if !ok {
+		h.wNotFound(w)
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "", "shell":
+		mode = "shell"
+		if p.Path == "" {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]string{"error": "project has no path"})
+			return
+		}
+	case "attach":
+		if _, ok := h.stdins.Load(id); !ok {
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, map[string]string{"error": "no interactive step is running"})
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "mode must be shell or attach"})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader has replied
+	}
+	defer conn.Close()
+
+	s := &termSession{h: h, id: strconv.FormatInt(time.Now().UnixNano(), 36), project: id, remote: r.RemoteAddr, conn: conn}
+	recPath := filepath.Join(h.audit.Dir(), "sessions", s.id+".log")
+	if err := os.MkdirAll(filepath.Dir(recPath), 0o700); err == nil {
+		s.rec, _ = os.OpenFile(recPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	}
+	if s.rec != nil {
+		defer s.rec.Close()
+	}
+	s.audit("terminal.open", mode+" in "+p.Path)
+	started := time.Now()
+	if mode == "shell" {
+		err = s.runShell(p)
+	} else {
+		err = s.runAttach()
+	}
+	s.flushInput()
+	detail := "duration " + time.Since(started).Round(time.Second).String()
+	if err != nil {
+		detail += ": " + err.Error()
+	}
+	s.audit("terminal.close", detail)
+}
+
+func (s *termSession) audit(action, detail string) {
+	e := audit.Event{Action: action, Remote: s.remote, Project: s.project, Session: s.id, Detail: detail}
+	if err := s.h.audit.Record(e); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// recordInput adds typed input to the audit log, one event per line.
+func (s *termSession) recordInput(data string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range []byte(data) {
+		if c == '\r' || c == '\n' {
+			s.emitInput()
+			continue
+		}
+		if len(s.input) < maxAuditInputLine {
+			s.input = append(s.input, c)
+		}
+	}
+}
+
+func (s *termSession) flushInput() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.emitInput()
+}
+
+func (s *termSession) emitInput() {
+	if len(s.input) == 0 {
+		return
+	}
+	s.audit("terminal.input", string(s.input))
+	s.input = s.input[:0]
+}
+
+// send writes output to the client and the session recording. It must only
+// be called from one goroutine at a time.
+func (s *termSession) send(b []byte) error {
+	if s.rec != nil {
+		s.rec.Write(b)
+	}
+	return s.conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// readInput processes client messages until the connection closes.
+func (s *termSession) readInput(write func([]byte) error, resize func(cols, rows uint16)) {
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var m termMessage
+		if json.Unmarshal(data, &m) != nil {
+			continue
+		}
+		switch m.Type {
+		case "input":
+			s.recordInput(m.Data)
+			if write([]byte(m.Data)) != nil {
+				return
+			}
+		case "resize":
+			if resize != nil && m.Cols > 0 && m.Rows > 0 {
+				resize(m.Cols, m.Rows)
+			}
+		}
+	}
+}
+
+// runShell runs the user's shell on a PTY in the project path.
+func (s *termSession) runShell(p state.Project) error {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+		if _, err := os.Stat("/bin/bash"); err == nil {
+			shell = "/bin/bash"
+		}
+	}
+	cmd := exec.Command(shell)
+	cmd.Dir = p.Path
+	cmd.Env = append(os.Environ(), "TERM=xterm-256color", "PI_MANAGER_PROJECT="+p.ID)
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: 80, Rows: 24})
+	if err != nil {
+		s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "cannot start shell"))
+		return err
+	}
+	defer ptmx.Close()
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+		// end the session even if jobs the shell left behind keep the PTY open
+		s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shell exited"), time.Now().Add(time.Second))
+		s.conn.Close()
+	}()
+
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		buf := make([]byte, 4096)
+		for {
+			n, err := ptmx.Read(buf)
+			if n > 0 && s.send(buf[:n]) != nil {
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	s.readInput(func(b []byte) error {
+		_, err := ptmx.Write(b)
+		return err
+	}, func(cols, rows uint16) {
+		pty.Setsize(ptmx, &pty.Winsize{Cols: cols, Rows: rows})
+	})
+
+	// the shell leads its own session; hang up everything still in it,
+	// including jobs the shell started in the background
+	terminate(append([]int{-cmd.Process.Pid}, sessionPIDs(cmd.Process.Pid)...), syscall.SIGHUP, terminalCloseGrace)
+	<-exited
+	ptmx.Close()
+	select {
+	case <-outputDone:
+	case <-time.After(terminalCloseGrace):
+	}
+	return nil
+}
+
+// sessionPIDs returns the processes in session sid.
+func sessionPIDs(sid int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// after the parenthesized command name: state, ppid, pgrp, session
+		i := strings.LastIndexByte(string(stat), ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) > 3 && fields[3] == strconv.Itoa(sid) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// runAttach connects the client to the stdin of the project's running step
+// and streams the run's output from now on.
+func (s *termSession) runAttach() error {
+	runs := s.h.store.GetRuns(s.project)
+	if len(runs) == 0 {
+		return fmt.Errorf("no run")
+	}
+	run := runs[0].ID
+	offset := int64(-1)
+	if c, err := s.h.logs.Read(s.project, run, -1, 0); err == nil {
+		offset = c.Size
+	}
+
+	stop := make(chan struct{})
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		ticker := time.NewTicker(attachPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			c, err := s.h.logs.Read(s.project, run, offset, maxLogLimit)
+			if err == nil && len(c.Lines) > 0 {
+				var b strings.Builder
+				for _, ln := range c.Lines {
+					b.WriteString(ln.String())
+					b.WriteString("\r\n")
+				}
+				if s.send([]byte(b.String())) != nil {
+					return
+				}
+				offset = c.Next
+				continue
+			}
+			if _, running := s.h.stdins.Load(s.project); !running {
+				s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "step finished"))
+				return
+			}
+		}
+	}()
+
+	s.readInput(func(b []byte) error {
+		stdin, ok := s.h.stdins.Load(s.project)
+		if !ok {
+			return errNotRunning
+		}
+		// terminals send carriage returns; programs reading a pipe expect newlines
+		_, err := stdin.(*os.File).Write([]byte(strings.ReplaceAll(string(b), "\r", "\n")))
+		return err
+	}, nil)
+	close(stop)
+	<-outputDone
+	return nil
+}
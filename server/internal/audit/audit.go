@@ -0,0 +1,65 @@
+// Package audit records security-relevant actions in an append-only log of
+// JSON lines.
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Event is one audit record. Fields that do not apply are left empty.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"` // e.g. terminal.open, terminal.input, terminal.close
+	Remote  string    `json:"remote,omitempty"`
+	Project string    `json:"project,omitempty"`
+	Session string    `json:"session,omitempty"`
+	Path    string    `json:"path,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Logger appends events to a file.
+type Logger struct {
+	path string
+	mu   sync.Mutex
+}
+
+// New returns a Logger writing to path.
+func New(path string) *Logger {
+	return &Logger{path: path}
+}
+
+// Dir is the directory holding the audit log, for related files such as
+// session recordings.
+func (l *Logger) Dir() string {
+	return filepath.Dir(l.path)
+}
+
+// Record appends an event. The file is opened per event so it can be
+// rotated externally.
+func (l *Logger) Record(e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
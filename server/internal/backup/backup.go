@@ -0,0 +1,300 @@
+// Package backup writes and reads archives of pi-manager's state, to
+// restore it later or to clone one machine's setup onto another.
+//
+// An archive is a gzipped tar file holding:
+//
+//	manifest.json     format version, origin, counts and file checksums
+//	state.json        projects, runs, hooks and templates, in the state file format
+//	history.json      metric history
+//	secrets.json.enc  the hooks' secrets, encrypted with a passphrase
+//
+// The hooks in state.json carry no secrets. The projects' runtime state,
+// logs and artifacts are not part of an archive.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// Format identifies pi-manager archives in their manifest.
+const Format = "pi-manager-backup"
+
+// Version is the version of the archive format this build writes. The
+// state inside an archive is versioned separately, like the state file.
+const Version = 1
+
+// maxArchive caps the unpacked size of an archive.
+const maxArchive = 256 << 20
+
+// Files of an archive.
+const (
+	manifestFile = "manifest.json"
+	stateFile    = "state.json"
+	historyFile  = "history.json"
+	secretsFile  = "secrets.json.enc"
+)
+
+// What an archive holds of the hooks' secrets.
+const (
+	SecretsEncrypted = "encrypted"
+	SecretsOmitted   = "omitted" // written without a passphrase
+	SecretsNone      = "none"    // no hook had a secret
+)
+
+// Manifest describes an archive.
+type Manifest struct {
+	Format       string            `json:"format"`
+	Version      int               `json:"version"`
+	CreatedAt    time.Time         `json:"created_at"`
+	Hostname     string            `json:"hostname,omitempty"`
+	StateVersion int               `json:"state_version"`
+	Secrets      string            `json:"secrets"`
+	Counts       Counts            `json:"counts"`
+	Files        map[string]string `json:"files"` // name → SHA-256 of the content
+}
+
+// Counts are the number of records in an archive.
+type Counts struct {
+	Projects  int `json:"projects"`
+	Templates int `json:"templates"`
+	Hooks     int `json:"hooks"`
+	Runs      int `json:"runs"`
+	History   int `json:"history"`
+}
+
+// Archive is a decoded backup.
+type Archive struct {
+	Manifest Manifest
+	Contents state.Contents
+}
+
+// ErrNewerVersion is returned for archives written by a newer pi-manager.
+var ErrNewerVersion = errors.New("backup was written by a newer version of pi-manager")
+
+// ErrNeedPassphrase is returned when an archive holds encrypted secrets and
+// no passphrase was given.
+var ErrNeedPassphrase = errors.New("the backup holds encrypted secrets, a passphrase is required")
+
+// Write writes an archive of c to w. The hooks' secrets are encrypted with
+// passphrase; without one they are left out.
+func Write(w io.Writer, c state.Contents, passphrase string) (Manifest, error) {
+	m := Manifest{
+		Format:       Format,
+		Version:      Version,
+		CreatedAt:    time.Now().UTC(),
+		StateVersion: state.SchemaVersion,
+		Secrets:      SecretsNone,
+		Files:        map[string]string{},
+		Counts: Counts{
+			Projects:  len(c.Projects),
+			Templates: len(c.Templates),
+			Hooks:     len(c.Hooks),
+			History:   len(c.History),
+		},
+	}
+	m.Hostname, _ = os.Hostname()
+	for _, rs := range c.Runs {
+		m.Counts.Runs += len(rs)
+	}
+
+	files := map[string][]byte{}
+	secrets := map[string]string{}
+	hooks := make([]state.Hook, len(c.Hooks))
+	for i, hk := range c.Hooks {
+		if hk.Secret != "" {
+			secrets[hk.ID] = hk.Secret
+			hk.Secret = ""
+		}
+		hooks[i] = hk
+	}
+	c.Hooks = hooks
+	if len(secrets) > 0 {
+		m.Secrets = SecretsOmitted
+		if passphrase != "" {
+			data, err := seal(secrets, passphrase)
+			if err != nil {
+				return m, err
+			}
+			files[secretsFile] = data
+			m.Secrets = SecretsEncrypted
+		}
+	}
+	var err error
+	if files[stateFile], err = state.EncodeState(c); err != nil {
+		return m, err
+	}
+	history := c.History
+	if history == nil {
+		history = []state.PiHealthStats{}
+	}
+	if files[historyFile], err = json.Marshal(history); err != nil {
+		return m, err
+	}
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		m.Files[name] = hex.EncodeToString(sum[:])
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return m, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: m.CreatedAt, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	// the manifest comes first, so a reader can reject an archive early
+	if err := add(manifestFile, manifest); err != nil {
+		return m, err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := add(name, files[name]); err != nil {
+			return m, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return m, err
+	}
+	return m, gz.Close()
+}
+
+// Read reads an archive, checking its files against the manifest and
+// decrypting the hooks' secrets with passphrase. State in an older format
+// is migrated.
+func Read(r io.Reader, passphrase string) (Archive, error) {
+	var a Archive
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return a, fmt.Errorf("not a backup: %w", err)
+	}
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return a, fmt.Errorf("corrupt backup: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, ok := files[hdr.Name]; ok {
+			return a, fmt.Errorf("corrupt backup: %s appears twice", hdr.Name)
+		}
+		total += hdr.Size
+		if total > maxArchive {
+			return a, errors.New("backup too large")
+		}
+		data, err := io.ReadAll(io.LimitReader(tr, hdr.Size))
+		if err != nil {
+			return a, fmt.Errorf("corrupt backup: %w", err)
+		}
+		files[hdr.Name] = data
+	}
+
+	manifest, ok := files[manifestFile]
+	if !ok {
+		return a, errors.New("not a backup: no " + manifestFile)
+	}
+	m := &a.Manifest
+	if err := json.Unmarshal(manifest, m); err != nil {
+		return a, fmt.Errorf("corrupt backup: %s: %w", manifestFile, err)
+	}
+	if m.Format != Format {
+		return a, fmt.Errorf("not a backup: format %q", m.Format)
+	}
+	if m.Version > Version {
+		return a, fmt.Errorf("%w (format version %d, this build reads up to %d)", ErrNewerVersion, m.Version, Version)
+	}
+	for name, data := range files {
+		if name == manifestFile {
+			continue
+		}
+		want, ok := m.Files[name]
+		if !ok {
+			return a, fmt.Errorf("corrupt backup: %s is not in the manifest", name)
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != want {
+			return a, fmt.Errorf("corrupt backup: %s does not match its checksum", name)
+		}
+	}
+	for name := range m.Files {
+		if _, ok := files[name]; !ok {
+			return a, fmt.Errorf("corrupt backup: %s is missing", name)
+		}
+	}
+	if _, ok := files[stateFile]; !ok {
+		return a, fmt.Errorf("corrupt backup: %s is missing", stateFile)
+	}
+
+	if a.Contents, err = state.DecodeState(files[stateFile]); err != nil {
+		return a, fmt.Errorf("%s: %w", stateFile, err)
+	}
+	if data, ok := files[historyFile]; ok {
+		if err := json.Unmarshal(data, &a.Contents.History); err != nil {
+			return a, fmt.Errorf("corrupt backup: %s: %w", historyFile, err)
+		}
+	}
+	if m.Secrets == SecretsEncrypted {
+		if passphrase == "" {
+			return a, ErrNeedPassphrase
+		}
+		data, ok := files[secretsFile]
+		if !ok {
+			return a, fmt.Errorf("corrupt backup: %s is missing", secretsFile)
+		}
+		secrets, err := open(data, passphrase)
+		if err != nil {
+			return a, err
+		}
+		for i, hk := range a.Contents.Hooks {
+			a.Contents.Hooks[i].Secret = secrets[hk.ID]
+		}
+	}
+	return a, nil
+}
+
+// ReadFile reads an archive from a file.
+func ReadFile(path, passphrase string) (Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Archive{}, err
+	}
+	defer f.Close()
+	return Read(f, passphrase)
+}
+
+// Encode is Write into memory, for callers that must not send half an
+// archive.
+func Encode(c state.Contents, passphrase string) ([]byte, Manifest, error) {
+	var buf bytes.Buffer
+	m, err := Write(&buf, c, passphrase)
+	return buf.Bytes(), m, err
+}
@@ -0,0 +1,97 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+func testContents() state.Contents {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	return state.Contents{
+		Projects: []state.ProjectConfig{
+			{ID: "api", Revision: 3, Path: "/srv/api", Ports: []string{"8080"}, Pipeline: []state.PipelineStep{{Name: "build", Cmd: "make"}}},
+			{ID: "web", Revision: 1, Template: "node"},
+		},
+		Runs: map[string][]state.Run{
+			"api": {{ID: "1", Project: "api", Trigger: "manual", Status: "SUCCEEDED", StartedAt: at}},
+		},
+		Hooks: []state.Hook{
+			{ID: "push", Project: "api", Action: "deploy", Secret: "s3cret", Branches: []string{"main"}},
+		},
+		Templates: []state.Template{
+			{ID: "node", Pipeline: []state.PipelineStep{{Name: "install", Cmd: "npm ci"}}},
+		},
+		History: []state.PiHealthStats{{Time: at, CPUUsage: 12.5, Temperature: 48}},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	c := testContents()
+	data, m, err := Encode(c, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Secrets != SecretsEncrypted {
+		t.Errorf("secrets = %s, want %s", m.Secrets, SecretsEncrypted)
+	}
+	if want := (Counts{Projects: 2, Templates: 1, Hooks: 1, Runs: 1, History: 1}); m.Counts != want {
+		t.Errorf("counts = %+v, want %+v", m.Counts, want)
+	}
+	if c.Hooks[0].Secret != "s3cret" {
+		t.Error("Encode cleared the secret of the caller's hook")
+	}
+
+	a, err := Read(bytes.NewReader(data), "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equal(a.Contents, c) {
+		t.Errorf("read back %+v, want %+v", a.Contents, c)
+	}
+	if a.Manifest.Format != Format || a.Manifest.Version != Version || a.Manifest.StateVersion != state.SchemaVersion {
+		t.Errorf("manifest = %+v", a.Manifest)
+	}
+}
+
+func TestReadPassphrase(t *testing.T) {
+	data, _, err := Encode(testContents(), "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Read(bytes.NewReader(data), "battery staple"); !errors.Is(err, ErrPassphrase) {
+		t.Errorf("wrong passphrase: error = %v, want ErrPassphrase", err)
+	}
+	if _, err := Read(bytes.NewReader(data), ""); !errors.Is(err, ErrNeedPassphrase) {
+		t.Errorf("no passphrase: error = %v, want ErrNeedPassphrase", err)
+	}
+}
+
+func TestWithoutPassphrase(t *testing.T) {
+	data, m, err := Encode(testContents(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Secrets != SecretsOmitted {
+		t.Errorf("secrets = %s, want %s", m.Secrets, SecretsOmitted)
+	}
+	if bytes.Contains(data, []byte("s3cret")) {
+		t.Error("archive holds the secret in the clear")
+	}
+	a, err := Read(bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Contents.Hooks) != 1 || a.Contents.Hooks[0].Secret != "" {
+		t.Errorf("hooks = %+v, want the hook without its secret", a.Contents.Hooks)
+	}
+}
+
+func TestReadNotABackup(t *testing.T) {
+	if _, err := Read(bytes.NewReader([]byte("plain text")), ""); err == nil {
+		t.Error("no error")
+	}
+}
@@ -0,0 +1,105 @@
+package backup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrPassphrase is returned when the secrets of an archive cannot be
+// decrypted.
+var ErrPassphrase = errors.New("wrong passphrase, or the secrets in the backup are damaged")
+
+// scrypt parameters for new archives: about 32 MiB and a fraction of a
+// second on a Raspberry Pi.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// sealed is the encrypted secrets file: AES-256-GCM with a key derived
+// from the passphrase by scrypt.
+type sealed struct {
+	KDF    string `json:"kdf"`
+	N      int    `json:"n"`
+	R      int    `json:"r"`
+	P      int    `json:"p"`
+	Salt   []byte `json:"salt"`
+	Cipher string `json:"cipher"`
+	Nonce  []byte `json:"nonce"`
+	Data   []byte `json:"data"`
+}
+
+// secretsAD binds the ciphertext to its purpose.
+var secretsAD = []byte(Format + " secrets")
+
+// seal encrypts the secrets, by hook id, with passphrase.
+func seal(secrets map[string]string, passphrase string) ([]byte, error) {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	s := sealed{KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: make([]byte, 16), Cipher: "aes-256-gcm"}
+	if _, err := rand.Read(s.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(s, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	s.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(s.Nonce); err != nil {
+		return nil, err
+	}
+	s.Data = gcm.Seal(nil, s.Nonce, plain, secretsAD)
+	return json.MarshalIndent(s, "", "  ")
+}
+
+// open decrypts what seal wrote.
+func open(data []byte, passphrase string) (map[string]string, error) {
+	var s sealed
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("corrupt backup: %s: %w", secretsFile, err)
+	}
+	if s.KDF != "scrypt" || s.Cipher != "aes-256-gcm" {
+		return nil, fmt.Errorf("corrupt backup: %s: unsupported encryption %s/%s", secretsFile, s.KDF, s.Cipher)
+	}
+	gcm, err := newGCM(s, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt backup: %s: %w", secretsFile, err)
+	}
+	if len(s.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("corrupt backup: %s: invalid nonce", secretsFile)
+	}
+	plain, err := gcm.Open(nil, s.Nonce, s.Data, secretsAD)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	var secrets map[string]string
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return nil, fmt.Errorf("corrupt backup: %s: %w", secretsFile, err)
+	}
+	return secrets, nil
+}
+
+func newGCM(s sealed, passphrase string) (cipher.AEAD, error) {
+	// bound the work an archive can ask for
+	if s.N > 1<<20 || s.R > 32 || s.P > 16 {
+		return nil, errors.New("scrypt parameters too large")
+	}
+	key, err := scrypt.Key([]byte(passphrase), s.Salt, s.N, s.R, s.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,289 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// Restore modes.
+const (
+	Merge   = "merge"   // add and update what the archive holds, keep the rest
+	Replace = "replace" // also remove what the archive does not hold
+)
+
+// Change is what a restore does with one project, template or hook.
+type Change struct {
+	ID     string `json:"id"`
+	Action string `json:"action"` // create, update, unchanged, delete, skip
+	Reason string `json:"reason,omitempty"`
+}
+
+// Plan previews a restore.
+type Plan struct {
+	Mode      string   `json:"mode"`
+	Manifest  Manifest `json:"manifest"`
+	Projects  []Change `json:"projects"`
+	Templates []Change `json:"templates"`
+	Hooks     []Change `json:"hooks"`
+	Runs      int      `json:"runs"`    // runs added
+	History   int      `json:"history"` // metric samples added
+	Warnings  []string `json:"warnings,omitempty"`
+}
+
+// Validator checks the records a restore would store; a record it rejects
+// is skipped. Project is given the templates and projects there would be
+// after the restore.
+type Validator interface {
+	Project(p state.ProjectConfig, templates map[string]state.Template, projects map[string]state.ProjectConfig) error
+	Template(t state.Template) error
+	Hook(hk state.Hook) error
+}
+
+// NewPlan compares an archive with the current contents of a store. It
+// returns the plan along with the contents to pass to Store.Restore.
+// Records v rejects are skipped, keeping the current record with the same
+// id, if any, in either mode. A hook whose secret was left out of the
+// archive keeps its current secret, or is skipped if it is new, as a hook
+// nobody knows the secret of accepts no deliveries.
+func NewPlan(cur state.Contents, a Archive, mode string, v Validator) (Plan, state.Contents) {
+	in := a.Contents
+	plan := Plan{Mode: mode, Manifest: a.Manifest, Projects: []Change{}, Templates: []Change{}, Hooks: []Change{}}
+	replace := mode == Replace
+	skip := func(id, reason string) Change {
+		return Change{ID: id, Action: "skip", Reason: reason}
+	}
+
+	// templates first: projects are checked against the ones restored
+	curTemplates := map[string]state.Template{}
+	for _, t := range cur.Templates {
+		curTemplates[t.ID] = t
+	}
+	templates := map[string]state.Template{}
+	if !replace {
+		for id, t := range curTemplates {
+			templates[id] = t
+		}
+	}
+	restoredTemplates := []state.Template{}
+	var skippedTemplates []Change
+	for _, t := range in.Templates {
+		if err := v.Template(t); err != nil {
+			skippedTemplates = append(skippedTemplates, skip(t.ID, err.Error()))
+			if old, ok := curTemplates[t.ID]; ok {
+				t = old
+			} else {
+				continue
+			}
+		}
+		templates[t.ID] = t
+		restoredTemplates = append(restoredTemplates, t)
+	}
+	in.Templates = restoredTemplates
+	inTemplates, oldTemplates := map[string]interface{}{}, map[string]interface{}{}
+	for _, t := range in.Templates {
+		inTemplates[t.ID] = t
+	}
+	for id, t := range curTemplates {
+		oldTemplates[id] = t
+	}
+	plan.Templates = withSkipped(diff(inTemplates, oldTemplates, replace), skippedTemplates)
+
+	curProjects := map[string]state.ProjectConfig{}
+	for _, p := range cur.Projects {
+		curProjects[p.ID] = p
+	}
+	projects := map[string]state.ProjectConfig{}
+	if !replace {
+		for id, p := range curProjects {
+			projects[id] = p
+		}
+	}
+	for _, p := range in.Projects {
+		projects[p.ID] = p
+	}
+	exists := map[string]bool{}
+	restored := []state.ProjectConfig{}
+	for _, p := range in.Projects {
+		old, ok := curProjects[p.ID]
+		if err := v.Project(p, templates, projects); err != nil {
+			plan.Projects = append(plan.Projects, skip(p.ID, err.Error()))
+			delete(in.Runs, p.ID)
+			if ok {
+				// kept as it is, also by a replace
+				exists[p.ID] = true
+				restored = append(restored, old)
+			}
+			continue
+		}
+		exists[p.ID] = true
+		restored = append(restored, p)
+		switch {
+		case !ok:
+			plan.Projects = append(plan.Projects, Change{ID: p.ID, Action: "create"})
+		case state.SameConfig(old, p):
+			plan.Projects = append(plan.Projects, Change{ID: p.ID, Action: "unchanged"})
+			continue
+		default:
+			plan.Projects = append(plan.Projects, Change{ID: p.ID, Action: "update"})
+			if old.Source != "" {
+				plan.Warnings = append(plan.Warnings, fmt.Sprintf("project %s is defined by %s; the restored configuration shows as drift until the file changes", p.ID, old.Source))
+			}
+		}
+		if p.Repo == "" && p.Path != "" {
+			if _, err := os.Stat(p.Path); err != nil {
+				plan.Warnings = append(plan.Warnings, fmt.Sprintf("project %s: path %s does not exist", p.ID, p.Path))
+			}
+		}
+	}
+	in.Projects = restored
+	for _, p := range cur.Projects {
+		if exists[p.ID] {
+			continue
+		}
+		if replace {
+			plan.Projects = append(plan.Projects, Change{ID: p.ID, Action: "delete"})
+		} else {
+			exists[p.ID] = true
+		}
+	}
+
+	curHooks := map[string]state.Hook{}
+	for _, hk := range cur.Hooks {
+		curHooks[hk.ID] = hk
+	}
+	hooks := []state.Hook{}
+	inHooks, oldHooks := map[string]interface{}{}, map[string]interface{}{}
+	var skippedHooks []Change
+	for _, hk := range in.Hooks {
+		old, ok := curHooks[hk.ID]
+		reason := ""
+		if err := v.Hook(hk); err != nil {
+			reason = err.Error()
+		} else if hk.Secret == "" && !ok {
+			reason = "its secret is not in the backup"
+		}
+		if reason != "" {
+			skippedHooks = append(skippedHooks, skip(hk.ID, reason))
+			if ok {
+				hooks = append(hooks, old)
+				inHooks[old.ID] = old
+			}
+			continue
+		}
+		if hk.Secret == "" {
+			hk.Secret = old.Secret
+		}
+		if !exists[hk.Project] {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("hook %s: project %s does not exist", hk.ID, hk.Project))
+		}
+		hooks = append(hooks, hk)
+		inHooks[hk.ID] = hk
+	}
+	in.Hooks = hooks
+	for id, hk := range curHooks {
+		oldHooks[id] = hk
+	}
+	plan.Hooks = withSkipped(diff(inHooks, oldHooks, replace), skippedHooks)
+
+	for id, rs := range in.Runs {
+		if !exists[id] {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, r := range cur.Runs[id] {
+			seen[r.ID] = true
+		}
+		for _, r := range rs {
+			if !seen[r.ID] {
+				plan.Runs++
+			}
+		}
+	}
+	seen := map[int64]bool{}
+	for _, h := range cur.History {
+		seen[h.Time.UnixNano()] = true
+	}
+	for _, h := range in.History {
+		if !seen[h.Time.UnixNano()] {
+			plan.History++
+		}
+	}
+
+	sort.Slice(plan.Projects, func(i, j int) bool { return plan.Projects[i].ID < plan.Projects[j].ID })
+	return plan, in
+}
+
+// withSkipped replaces the changes of skipped records, which diff lists as
+// unchanged when the current record is kept, with the skips.
+func withSkipped(changes, skipped []Change) []Change {
+	ids := map[string]bool{}
+	for _, c := range skipped {
+		ids[c.ID] = true
+	}
+	out := skipped
+	for _, c := range changes {
+		if !ids[c.ID] {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// diff lists the changes restoring records makes to the current ones,
+// both by id.
+func diff(in, cur map[string]interface{}, replace bool) []Change {
+	out := []Change{}
+	for id, v := range in {
+		prev, ok := cur[id]
+		switch {
+		case !ok:
+			out = append(out, Change{ID: id, Action: "create"})
+		case equal(prev, v):
+			out = append(out, Change{ID: id, Action: "unchanged"})
+		default:
+			out = append(out, Change{ID: id, Action: "update"})
+		}
+	}
+	if replace {
+		for id := range cur {
+			if _, ok := in[id]; !ok {
+				out = append(out, Change{ID: id, Action: "delete"})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func equal(a, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+// Changed returns the ids of the projects the plan updates or deletes.
+func (p Plan) Changed() []string {
+	var out []string
+	for _, c := range p.Projects {
+		if c.Action == "update" || c.Action == "delete" {
+			out = append(out, c.ID)
+		}
+	}
+	return out
+}
+
+// Deleted returns the ids of the projects the plan deletes.
+func (p Plan) Deleted() []string {
+	var out []string
+	for _, c := range p.Projects {
+		if c.Action == "delete" {
+			out = append(out, c.ID)
+		}
+	}
+	return out
+}
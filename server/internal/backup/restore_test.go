@@ -0,0 +1,156 @@
+package backup
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// rejectIDs rejects the records with the given ids.
+type rejectIDs map[string]bool
+
+func (v rejectIDs) check(id string) error {
+	if v[id] {
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func (v rejectIDs) Project(p state.ProjectConfig, _ map[string]state.Template, _ map[string]state.ProjectConfig) error {
+	return v.check(p.ID)
+}
+
+func (v rejectIDs) Template(t state.Template) error { return v.check(t.ID) }
+func (v rejectIDs) Hook(hk state.Hook) error        { return v.check(hk.ID) }
+
+func actionsOf(changes []Change) map[string]string {
+	out := map[string]string{}
+	for _, c := range changes {
+		out[c.ID] = c.Action
+	}
+	return out
+}
+
+func ids(projects []state.ProjectConfig) []string {
+	out := []string{}
+	for _, p := range projects {
+		out = append(out, p.ID)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// restoreFixture returns the current contents and an archive that changes
+// api, adds new, holds a bad project that is rejected and lacks old.
+func restoreFixture() (state.Contents, Archive) {
+	cur := state.Contents{
+		Projects: []state.ProjectConfig{
+			{ID: "api", Revision: 2, Ports: []string{"8080"}},
+			{ID: "bad", Revision: 1, Description: "current"},
+			{ID: "old", Revision: 1},
+			{ID: "same", Revision: 1, Description: "same"},
+		},
+		Hooks: []state.Hook{
+			{ID: "push", Project: "api", Action: "deploy", Secret: "current"},
+		},
+		Runs: map[string][]state.Run{"api": {{ID: "1", Project: "api"}}},
+	}
+	a := Archive{Contents: state.Contents{
+		Projects: []state.ProjectConfig{
+			{ID: "api", Revision: 5, Ports: []string{"9090"}},
+			{ID: "bad", Revision: 1, Description: "archived"},
+			{ID: "new", Revision: 1},
+			{ID: "same", Revision: 7, Description: "same"},
+		},
+		Hooks: []state.Hook{
+			{ID: "push", Project: "api", Action: "deploy"},  // secret left out
+			{ID: "orphan", Project: "new", Action: "start"}, // new, secret left out
+		},
+		Runs: map[string][]state.Run{
+			"api": {{ID: "1", Project: "api"}, {ID: "2", Project: "api"}},
+			"bad": {{ID: "3", Project: "bad"}},
+			"new": {{ID: "4", Project: "new"}},
+		},
+	}}
+	return cur, a
+}
+
+func TestNewPlanMerge(t *testing.T) {
+	cur, a := restoreFixture()
+	plan, got := NewPlan(cur, a, Merge, rejectIDs{"bad": true})
+
+	want := map[string]string{"api": "update", "bad": "skip", "new": "create", "same": "unchanged"}
+	if p := actionsOf(plan.Projects); !reflect.DeepEqual(p, want) {
+		t.Errorf("projects = %v, want %v", p, want)
+	}
+	if h := actionsOf(plan.Hooks); !reflect.DeepEqual(h, map[string]string{"push": "unchanged", "orphan": "skip"}) {
+		t.Errorf("hooks = %v, want push unchanged with its current secret and orphan skipped", h)
+	}
+	if plan.Runs != 2 {
+		t.Errorf("runs added = %d, want 2, without those of the skipped project", plan.Runs)
+	}
+	if len(plan.Deleted()) != 0 {
+		t.Errorf("merge deletes %v", plan.Deleted())
+	}
+	if c := plan.Changed(); !reflect.DeepEqual(c, []string{"api"}) {
+		t.Errorf("changed = %v, want [api]", c)
+	}
+
+	// old is kept by a merge without being in the restored contents, which
+	// Store.Restore merges into the current ones
+	if p := ids(got.Projects); !reflect.DeepEqual(p, []string{"api", "bad", "new", "same"}) {
+		t.Errorf("restored projects = %v", p)
+	}
+	for _, p := range got.Projects {
+		if p.ID == "bad" && p.Description != "current" {
+			t.Errorf("skipped project restored as %+v, want the current one kept", p)
+		}
+	}
+	if len(got.Hooks) != 1 || got.Hooks[0].Secret != "current" {
+		t.Errorf("restored hooks = %+v, want push with its current secret", got.Hooks)
+	}
+	if _, ok := got.Runs["bad"]; ok {
+		t.Error("runs of the skipped project are restored")
+	}
+}
+
+func TestNewPlanReplace(t *testing.T) {
+	cur, a := restoreFixture()
+	plan, got := NewPlan(cur, a, Replace, rejectIDs{"bad": true})
+
+	want := map[string]string{"api": "update", "bad": "skip", "new": "create", "old": "delete", "same": "unchanged"}
+	if p := actionsOf(plan.Projects); !reflect.DeepEqual(p, want) {
+		t.Errorf("projects = %v, want %v", p, want)
+	}
+	if d := plan.Deleted(); !reflect.DeepEqual(d, []string{"old"}) {
+		t.Errorf("deleted = %v, want [old]", d)
+	}
+	if c := plan.Changed(); !reflect.DeepEqual(c, []string{"api", "old"}) {
+		t.Errorf("changed = %v, want [api old]", c)
+	}
+	// a rejected record keeps the current one, even in a replace
+	if p := ids(got.Projects); !reflect.DeepEqual(p, []string{"api", "bad", "new", "same"}) {
+		t.Errorf("restored projects = %v, want old left out", p)
+	}
+}
+
+func TestNewPlanRejectedNew(t *testing.T) {
+	_, a := restoreFixture()
+	plan, got := NewPlan(state.Contents{}, a, Replace, rejectIDs{"new": true, "orphan": true})
+	if p := actionsOf(plan.Projects); p["new"] != "skip" {
+		t.Errorf("new = %s, want skip", p["new"])
+	}
+	for _, p := range got.Projects {
+		if p.ID == "new" {
+			t.Error("rejected new project is restored")
+		}
+	}
+	for _, c := range plan.Hooks {
+		if c.ID == "orphan" && c.Reason != "rejected" {
+			t.Errorf("orphan skipped because %q, want the validator's reason", c.Reason)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package config loads the daemon's settings from a YAML file, environment
+// variables and command-line flags, in increasing order of precedence.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/davidrocha/pi-manager/internal/fsjail"
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// DefaultPath is read when no config file is given; it may be missing.
+const DefaultPath = "/etc/pi-manager/config.yaml"
+
+// EnvPrefix prefixes the environment variables overriding settings, e.g.
+// PI_MANAGER_ALLOW_ACTIONS=true. Lists are comma-separated.
+const EnvPrefix = "PI_MANAGER_"
+
+// Config holds the daemon settings. Addr, State and StateBackend only take
+// effect on startup; the others are reloaded on SIGHUP.
+type Config struct {
+	Addr             string   `yaml:"addr"`
+	State            string   `yaml:"state"`
+	StateBackend     string   `yaml:"state_backend"` // json or bolt
+	AllowActions     bool     `yaml:"allow_actions"`
+	AllowTerminal    bool     `yaml:"allow_terminal"`
+	RestoreRunning   bool     `yaml:"restore_running"`
+	FSBase           string   `yaml:"fs_base"`
+	FSRoots          []string `yaml:"fs_roots"` // path[:ro|:rw]
+	SnapshotInterval Duration `yaml:"snapshot_interval"`
+	HealthInterval   Duration `yaml:"health_interval"`
+	HistoryPoints    int      `yaml:"history_points"` // health samples kept
+	ProjectsDir      string   `yaml:"projects_dir"`   // *.project.yaml definitions synced into the store
+}
+
+// Duration is a time.Duration written as a string such as "30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalYAML(n *yaml.Node) error {
+	var s string
+	if err := n.Decode(&s); err != nil {
+		return err
+	}
+	return d.set(s)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	d.Duration = v
+	return nil
+}
+
+// Default returns the built-in settings.
+func Default() Config {
+	home, _ := os.UserHomeDir()
+	if home == "" {
+		home = "/"
+	}
+	return Config{
+		Addr:             "127.0.0.1:8080",
+		State:            "/var/lib/pi-manager/state.json",
+		StateBackend:     "json",
+		FSBase:           home,
+		SnapshotInterval: Duration{30 * time.Second},
+		HealthInterval:   Duration{60 * time.Second},
+		HistoryPoints:    state.DefaultHistoryPoints,
+	}
+}
+
+// LoadFile applies the settings in a YAML file to c. Unknown keys are
+// errors, so typos do not go unnoticed. With optional set, a missing file
+// is not an error.
+func (c *Config) LoadFile(path string, optional bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if optional && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// ApplyEnv applies PI_MANAGER_* environment variables to c.
+func (c *Config) ApplyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := EnvPrefix + strings.ToUpper(t.Field(i).Tag.Get("yaml"))
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), s); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(f reflect.Value, s string) error {
+	switch p := f.Addr().Interface().(type) {
+	case *string:
+		*p = s
+	case *bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		*p = b
+	case *int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		*p = n
+	case *Duration:
+		return p.set(s)
+	case *[]string:
+		*p = nil
+		for _, part := range strings.Split(s, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				*p = append(*p, part)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.Type())
+	}
+	return nil
+}
+
+// Validate checks the settings, reporting every problem found.
+func (c Config) Validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("addr: %v", err))
+	}
+	if c.State == "" {
+		errs = append(errs, errors.New("state: must not be empty"))
+	}
+	if c.StateBackend != "json" && c.StateBackend != "bolt" {
+		errs = append(errs, fmt.Errorf("state_backend: must be json or bolt, not %q", c.StateBackend))
+	}
+	if c.FSBase == "" {
+		errs = append(errs, errors.New("fs_base: must not be empty"))
+	}
+	for _, r := range c.FSRoots {
+		if _, err := fsjail.ParseRoot(r); err != nil {
+			errs = append(errs, fmt.Errorf("fs_roots: %v", err))
+		}
+	}
+	if c.SnapshotInterval.Duration < time.Second {
+		errs = append(errs, errors.New("snapshot_interval: must be at least 1s"))
+	}
+	if c.HealthInterval.Duration < time.Second {
+		errs = append(errs, errors.New("health_interval: must be at least 1s"))
+	}
+	if c.HistoryPoints < 1 {
+		errs = append(errs, errors.New("history_points: must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// Jail builds the file access jail: fs_base, writable, followed by
+// fs_roots.
+func (c Config) Jail() (*fsjail.Jail, error) {
+	roots := []fsjail.Root{{Path: c.FSBase, Mode: fsjail.ReadWrite}}
+	for _, spec := range c.FSRoots {
+		r, err := fsjail.ParseRoot(spec)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, r)
+	}
+	return fsjail.New(roots...)
+}
+
+// YAML renders the settings as a config file.
+func (c Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
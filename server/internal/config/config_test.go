@@ -0,0 +1,153 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeFile(t, `
+addr: 0.0.0.0:9000
+allow_actions: true
+fs_roots: [/srv, "/mnt/usb:ro"]
+health_interval: 5m
+history_points: 100
+`)
+	c := Default()
+	if err := c.LoadFile(path, false); err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.Addr = "0.0.0.0:9000"
+	want.AllowActions = true
+	want.FSRoots = []string{"/srv", "/mnt/usb:ro"}
+	want.HealthInterval = Duration{5 * time.Minute}
+	want.HistoryPoints = 100
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("loaded %+v, want %+v", c, want)
+	}
+}
+
+func TestLoadFileEmpty(t *testing.T) {
+	c := Default()
+	if err := c.LoadFile(writeFile(t, ""), false); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, Default()) {
+		t.Errorf("empty file changed the settings to %+v", c)
+	}
+}
+
+func TestLoadFileMissing(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "none.yaml")
+	c := Default()
+	if err := c.LoadFile(missing, true); err != nil {
+		t.Errorf("optional missing file: %v", err)
+	}
+	if err := c.LoadFile(missing, false); err == nil {
+		t.Error("required missing file: no error")
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := []struct {
+		name, data string
+		want       string // in the error
+	}{
+		{"unknown key", "addr: :80\nallow_action: true\n", "allow_action"},
+		{"invalid duration", "health_interval: soon\n", `invalid duration "soon"`},
+		{"wrong type", "history_points: many\n", "cannot unmarshal"},
+		{"syntax", "addr: [\n", "config.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			err := c.LoadFile(writeFile(t, tt.data), false)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	c := Default()
+	if err := c.LoadFile(writeFile(t, "addr: 0.0.0.0:9000\nallow_actions: true\nhistory_points: 100\n"), false); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PI_MANAGER_ADDR", "127.0.0.1:7000")
+	t.Setenv("PI_MANAGER_ALLOW_ACTIONS", "false")
+	t.Setenv("PI_MANAGER_FS_ROOTS", "/srv, /mnt/usb:ro,")
+	t.Setenv("PI_MANAGER_SNAPSHOT_INTERVAL", "10s")
+	if err := c.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	// the environment overrides the file, which overrides the defaults
+	if c.Addr != "127.0.0.1:7000" || c.AllowActions {
+		t.Errorf("addr %q, allow_actions %v, want the environment's", c.Addr, c.AllowActions)
+	}
+	if c.HistoryPoints != 100 {
+		t.Errorf("history_points = %d, want 100 from the file", c.HistoryPoints)
+	}
+	if c.HealthInterval != Default().HealthInterval {
+		t.Errorf("health_interval = %s, want the default", c.HealthInterval)
+	}
+	if want := []string{"/srv", "/mnt/usb:ro"}; !reflect.DeepEqual(c.FSRoots, want) {
+		t.Errorf("fs_roots = %q, want %q", c.FSRoots, want)
+	}
+	if c.SnapshotInterval.Duration != 10*time.Second {
+		t.Errorf("snapshot_interval = %s, want 10s", c.SnapshotInterval)
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := []struct {
+		name, value string
+	}{
+		{"PI_MANAGER_ALLOW_ACTIONS", "maybe"},
+		{"PI_MANAGER_HISTORY_POINTS", "lots"},
+		{"PI_MANAGER_HEALTH_INTERVAL", "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			c := Default()
+			if err := c.ApplyEnv(); err == nil || !strings.HasPrefix(err.Error(), tt.name+": ") {
+				t.Errorf("error = %v, want one naming %s", err, tt.name)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Errorf("defaults: %v", err)
+	}
+	c := Default()
+	c.Addr = "nowhere"
+	c.StateBackend = "sqlite"
+	c.HealthInterval = Duration{time.Millisecond}
+	c.HistoryPoints = 0
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("no error")
+	}
+	for _, key := range []string{"addr:", "state_backend:", "health_interval:", "history_points:"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("error %q does not report %s", err, key)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Package fsjail confines file access to a set of root directories.
+//
+// Paths are checked after resolving symlinks, so a link inside a root that
+// points elsewhere cannot be used to escape it, and containment is decided
+// per path component, so a root /home/pi does not admit /home/pi2.
+package fsjail
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Mode is the access a root allows.
+type Mode string
+
+const (
+	ReadOnly  Mode = "ro"
+	ReadWrite Mode = "rw"
+)
+
+var (
+	ErrOutside  = errors.New("path outside allowed roots")
+	ErrReadOnly = errors.New("path is read-only")
+)
+
+// Root is a directory files may be accessed below.
+type Root struct {
+	Path string `json:"path"` // absolute, with symlinks resolved
+	Mode Mode   `json:"mode"`
+}
+
+// ParseRoot parses "path", "path:ro" or "path:rw". Without a mode the root
+// is writable.
+func ParseRoot(spec string) (Root, error) {
+	r := Root{Path: spec, Mode: ReadWrite}
+	if i := strings.LastIndexByte(spec, ':'); i >= 0 {
+		switch Mode(spec[i+1:]) {
+		case ReadOnly, ReadWrite:
+			r.Path, r.Mode = spec[:i], Mode(spec[i+1:])
+		}
+	}
+	if r.Path == "" {
+		return Root{}, fmt.Errorf("empty root in %q", spec)
+	}
+	return r, nil
+}
+
+// Jail resolves paths against its roots. The first root is the default one
+// relative paths are resolved against.
+type Jail struct {
+	roots []Root
+}
+
+// New returns a Jail over roots, which must be existing directories.
+func New(roots ...Root) (*Jail, error) {
+	if len(roots) == 0 {
+		return nil, errors.New("no roots")
+	}
+	j := &Jail{}
+	for _, r := range roots {
+		abs, err := filepath.Abs(r.Path)
+		if err != nil {
+			return nil, err
+		}
+		real, err := filepath.EvalSymlinks(abs)
+		if err != nil {
+			return nil, fmt.Errorf("root %s: %w", r.Path, err)
+		}
+		if info, err := os.Stat(real); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("root %s is not a directory", r.Path)
+		}
+		if r.Mode == "" {
+			r.Mode = ReadWrite
+		}
+		if r.Mode != ReadOnly && r.Mode != ReadWrite {
+			return nil, fmt.Errorf("root %s: unknown mode %q", r.Path, r.Mode)
+		}
+		j.roots = append(j.roots, Root{Path: real, Mode: r.Mode})
+	}
+	return j, nil
+}
+
+// Roots returns the resolved roots.
+func (j *Jail) Roots() []Root {
+	return append([]Root(nil), j.roots...)
+}
+
+// Default returns the root relative paths are resolved against.
+func (j *Jail) Default() Root {
+	return j.roots[0]
+}
+
+// Resolve returns the real path of p, following symlinks including a final
+// one. Relative paths are taken relative to the default root. p need not
+// exist; its longest existing prefix is resolved. With write set, the root
+// containing the path must be writable.
+func (j *Jail) Resolve(p string, write bool) (string, error) {
+	abs := j.abs(p)
+	real, err := resolve(abs)
+	if err != nil {
+		return "", err
+	}
+	return real, j.check(real, write)
+}
+
+// ResolveLink is like Resolve but does not follow a final symlink, for
+// operations acting on a link itself such as deleting or renaming it. The
+// root directories themselves are refused with write set.
+func (j *Jail) ResolveLink(p string, write bool) (string, error) {
+	abs := j.abs(p)
+	dir, err := resolve(filepath.Dir(abs))
+	if err != nil {
+		return "", err
+	}
+	real := dir
+	if abs != filepath.Dir(abs) {
+		real = filepath.Join(dir, filepath.Base(abs))
+	}
+	if err := j.check(real, write); err != nil {
+		return "", err
+	}
+	if write && j.IsRoot(real) {
+		return "", fmt.Errorf("%w: cannot modify a root", ErrReadOnly)
+	}
+	return real, nil
+}
+
+// IsRoot reports whether real is one of the roots.
+func (j *Jail) IsRoot(real string) bool {
+	for _, r := range j.roots {
+		if r.Path == real {
+			return true
+		}
+	}
+	return false
+}
+
+// Rel returns real relative to the default root when it is inside it, and
+// real itself otherwise. Resolve accepts both forms.
+func (j *Jail) Rel(real string) string {
+	if root := j.roots[0].Path; within(root, real) {
+		rel, _ := filepath.Rel(root, real)
+		return rel
+	}
+	return real
+}
+
+// Contains reports whether real, an already resolved path, is inside a
+// root.
+func (j *Jail) Contains(real string) bool {
+	_, ok := j.rootOf(real)
+	return ok
+}
+
+func (j *Jail) abs(p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(j.roots[0].Path, p)
+}
+
+func (j *Jail) check(real string, write bool) error {
+	r, ok := j.rootOf(real)
+	if !ok {
+		return ErrOutside
+	}
+	if write && r.Mode != ReadWrite {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// rootOf returns the innermost root containing real, so a read-only root
+// nested in a writable one takes precedence.
+func (j *Jail) rootOf(real string) (Root, bool) {
+	var best Root
+	found := false
+	for _, r := range j.roots {
+		if within(r.Path, real) && (!found || len(r.Path) > len(best.Path)) {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
+
+// within reports whether p is root or below it.
+func within(root, p string) bool {
+	if root == string(filepath.Separator) {
+		return filepath.IsAbs(p)
+	}
+	return p == root || strings.HasPrefix(p, root+string(filepath.Separator))
+}
+
+// resolve evaluates the symlinks in abs. Components that do not exist yet
+// are appended to the resolved existing prefix; they cannot be links.
+func resolve(abs string) (string, error) {
+	var missing []string
+	for {
+		real, err := filepath.EvalSymlinks(abs)
+		if err == nil {
+			for i := len(missing) - 1; i >= 0; i-- {
+				real = filepath.Join(real, missing[i])
+			}
+			return real, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		if _, lerr := os.Lstat(abs); lerr == nil {
+			// abs exists, so it is a link pointing nowhere; its target
+			// could be anywhere once created
+			return "", fmt.Errorf("broken symlink %s: %w", filepath.Base(abs), os.ErrNotExist)
+		}
+		parent := filepath.Dir(abs)
+		if parent == abs {
+			return "", err
+		}
+		missing = append(missing, filepath.Base(abs))
+		abs = parent
+	}
+}
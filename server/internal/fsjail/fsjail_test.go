@@ -0,0 +1,126 @@
+package fsjail
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setup creates, below a temporary directory:
+//
+//	pi/            default root, writable
+//	pi/ro/         nested root, read-only
+//	pi/out -> ../pi2
+//	pi/ro/up -> ..
+//	pi2/secret
+func setup(t *testing.T) (*Jail, string) {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"pi/ro", "pi2"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "pi2", "secret"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../pi2", filepath.Join(dir, "pi", "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", filepath.Join(dir, "pi", "ro", "up")); err != nil {
+		t.Fatal(err)
+	}
+	j, err := New(Root{Path: filepath.Join(dir, "pi")}, Root{Path: filepath.Join(dir, "pi", "ro"), Mode: ReadOnly})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, dir
+}
+
+func TestResolve(t *testing.T) {
+	j, dir := setup(t)
+	pi := filepath.Join(dir, "pi")
+	tests := []struct {
+		name  string
+		path  string
+		write bool
+		want  string // relative to dir
+		err   error
+	}{
+		{"default root", "", false, "pi", nil},
+		{"relative", "a/b", true, "pi/a/b", nil},
+		{"absolute", filepath.Join(pi, "x"), true, "pi/x", nil},
+		{"dot dot", "../pi2/secret", false, "", ErrOutside},
+		{"sibling with common prefix", filepath.Join(dir, "pi2"), false, "", ErrOutside},
+		{"sibling below", filepath.Join(dir, "pi2", "secret"), false, "", ErrOutside},
+		{"symlink escape", "out/secret", false, "", ErrOutside},
+		{"symlink escape, missing file", "out/new", true, "", ErrOutside},
+		{"nested read-only root", "ro/f", false, "pi/ro/f", nil},
+		{"write in nested read-only root", "ro/f", true, "", ErrReadOnly},
+		{"link from read-only to writable root", "ro/up/f", true, "pi/f", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := j.Resolve(tt.path, tt.write)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Resolve(%q, %v) error = %v, want %v", tt.path, tt.write, err, tt.err)
+			}
+			if tt.err == nil && got != filepath.Join(dir, tt.want) {
+				t.Errorf("Resolve(%q, %v) = %s, want %s", tt.path, tt.write, got, filepath.Join(dir, tt.want))
+			}
+		})
+	}
+}
+
+func TestResolveLink(t *testing.T) {
+	j, dir := setup(t)
+	tests := []struct {
+		name  string
+		path  string
+		write bool
+		want  string // relative to dir
+		err   error
+	}{
+		{"link itself", "out", true, "pi/out", nil},
+		{"below link", "out/secret", true, "", ErrOutside},
+		{"read default root", "", false, "pi", nil},
+		{"modify default root", "", true, "", ErrReadOnly},
+		{"modify default root by absolute path", filepath.Join(dir, "pi"), true, "", ErrReadOnly},
+		{"modify nested root", "ro", true, "", ErrReadOnly},
+		{"link in read-only root", "ro/up", true, "", ErrReadOnly},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := j.ResolveLink(tt.path, tt.write)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ResolveLink(%q, %v) error = %v, want %v", tt.path, tt.write, err, tt.err)
+			}
+			if tt.err == nil && got != filepath.Join(dir, tt.want) {
+				t.Errorf("ResolveLink(%q, %v) = %s, want %s", tt.path, tt.write, got, filepath.Join(dir, tt.want))
+			}
+		})
+	}
+}
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		root, p string
+		want    bool
+	}{
+		{"/home/pi", "/home/pi", true},
+		{"/home/pi", "/home/pi/a", true},
+		{"/home/pi", "/home/pi2", false},
+		{"/home/pi", "/home/pi2/a", false},
+		{"/home/pi", "/home", false},
+		{"/", "/etc", true},
+	}
+	for _, tt := range tests {
+		if got := within(tt.root, tt.p); got != tt.want {
+			t.Errorf("within(%q, %q) = %v, want %v", tt.root, tt.p, got, tt.want)
+		}
+	}
+}
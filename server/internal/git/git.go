@@ -0,0 +1,177 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Status is a summary of a working copy.
+type Status struct {
+	Branch   string `json:"branch"`             // current branch, empty when detached
+	Commit   string `json:"commit"`             // full HEAD commit hash
+	Subject  string `json:"subject"`            // HEAD commit subject line
+	Dirty    bool   `json:"dirty"`              // uncommitted changes present
+	Upstream string `json:"upstream,omitempty"` // tracking branch, e.g. origin/main
+	Ahead    int    `json:"ahead"`              // commits not on upstream
+	Behind   int    `json:"behind"`             // upstream commits not checked out
+	Remote   string `json:"remote,omitempty"`   // origin URL
+}
+
+// ErrNotRepository is returned when dir is not inside a git working copy.
+var ErrNotRepository = errors.New("not a git repository")
+
+// ErrInvalidRef is returned for refs that are not valid ref names, or that
+// git would take for an option.
+var ErrInvalidRef = errors.New("invalid ref")
+
+// ValidRef checks a branch, tag or commit name before it is passed to git.
+func ValidRef(ref string) error {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("%w %q", ErrInvalidRef, ref)
+	}
+	if _, err := run(context.Background(), "", "check-ref-format", "--allow-onelevel", ref); err != nil {
+		return fmt.Errorf("%w %q", ErrInvalidRef, ref)
+	}
+	return nil
+}
+
+// IsRepository reports whether dir is inside a git working copy.
+func IsRepository(dir string) bool {
+	_, err := run(context.Background(), dir, "rev-parse", "--git-dir")
+	return err == nil
+}
+
+// GetStatus inspects the working copy at dir. It does not contact the remote;
+// call Fetch first for an up-to-date behind count.
+func GetStatus(dir string) (Status, error) {
+	ctx := context.Background()
+	var st Status
+	if !IsRepository(dir) {
+		return st, ErrNotRepository
+	}
+	out, err := run(ctx, dir, "log", "-1", "--format=%H%n%s")
+	if err != nil {
+		return st, err
+	}
+	if lines := strings.SplitN(out, "\n", 2); len(lines) == 2 {
+		st.Commit, st.Subject = lines[0], lines[1]
+	} else {
+		st.Commit = out
+	}
+	if out, err := run(ctx, dir, "symbolic-ref", "--quiet", "--short", "HEAD"); err == nil {
+		st.Branch = out
+	}
+	out, err = run(ctx, dir, "status", "--porcelain")
+	if err != nil {
+		return st, err
+	}
+	st.Dirty = out != ""
+	st.Remote, _ = run(ctx, dir, "remote", "get-url", "origin")
+
+	if up, err := run(ctx, dir, "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{upstream}"); err == nil {
+		st.Upstream = up
+		if out, err := run(ctx, dir, "rev-list", "--left-right", "--count", "HEAD...@{upstream}"); err == nil {
+			if f := strings.Fields(out); len(f) == 2 {
+				st.Ahead, _ = strconv.Atoi(f[0])
+				st.Behind, _ = strconv.Atoi(f[1])
+			}
+		}
+	}
+	return st, nil
+}
+
+// Head returns the commit checked out at dir.
+func Head(dir string) (string, error) {
+	return run(context.Background(), dir, "rev-parse", "HEAD")
+}
+
+// ChangedFiles lists the paths that differ between two commits.
+func ChangedFiles(dir, from, to string) ([]string, error) {
+	out, err := run(context.Background(), dir, "diff", "--name-only", from, to)
+	if err != nil {
+		return nil, err
+	}
+	if out == "" {
+		return []string{}, nil
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+// Clone clones repo into dir, checking out branch when given.
+func Clone(ctx context.Context, repo, branch, dir string, out io.Writer) error {
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return err
+	}
+	args := []string{"clone"}
+	if branch != "" {
+		if err := ValidRef(branch); err != nil {
+			return err
+		}
+		args = append(args, "--branch", branch)
+	}
+	args = append(args, "--", repo, dir)
+	return stream(ctx, "", out, args...)
+}
+
+// Fetch updates remote-tracking refs from origin.
+func Fetch(ctx context.Context, dir string, out io.Writer) error {
+	return stream(ctx, dir, out, "fetch", "--prune", "--tags", "origin")
+}
+
+// Checkout moves the working copy to ref. A ref naming a branch on origin is
+// checked out as that local branch and fast-forwarded; anything else (tag,
+// commit) is checked out as a detached HEAD. Invalid refs are refused with
+// ErrInvalidRef.
+func Checkout(ctx context.Context, dir, ref string, out io.Writer) error {
+	if err := ValidRef(ref); err != nil {
+		return err
+	}
+	if _, err := run(ctx, dir, "rev-parse", "--verify", "--quiet", "refs/remotes/origin/"+ref); err == nil {
+		if err := stream(ctx, dir, out, "checkout", ref, "--"); err != nil {
+			return err
+		}
+		return stream(ctx, dir, out, "merge", "--ff-only", "origin/"+ref)
+	}
+	return stream(ctx, dir, out, "checkout", "--detach", ref, "--")
+}
+
+// run executes a git command and returns its trimmed stdout.
+func run(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// stream executes a git command writing its output to out.
+func stream(ctx context.Context, dir string, out io.Writer, args ...string) error {
+	if out != nil {
+		fmt.Fprintf(out, "$ git %s\n", strings.Join(args, " "))
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	// never block on credential prompts
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package git
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestValidRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{"main", true},
+		{"feature/login", true},
+		{"v1.2.3", true},
+		{"0f85149", true},
+		{"0f85149c3e2d8a1b4f6e7d9c0a1b2c3d4e5f6a7b", true},
+		{"", false},
+		{"-b", false},
+		{"--upload-pack=touch /tmp/x", false},
+		{"--", false},
+		{"main..dev", false},
+		{"../main", false},
+		{"feature/..", false},
+		{"main.lock", false},
+		{"refs/heads/main.lock", false},
+		{"feature/", false},
+		{"a b", false},
+		{"a~1", false},
+		{"a^", false},
+		{"a:b", false},
+		{"@{-1}", false},
+	}
+	for _, tt := range tests {
+		err := ValidRef(tt.ref)
+		if tt.want && err != nil {
+			t.Errorf("ValidRef(%q) = %v, want nil", tt.ref, err)
+		}
+		if !tt.want && !errors.Is(err, ErrInvalidRef) {
+			t.Errorf("ValidRef(%q) = %v, want ErrInvalidRef", tt.ref, err)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+// Package logstore keeps the output of pipeline runs on disk.
+//
+// Output is stored as JSON lines recording when each line was written, the
+// step that wrote it and the stream it came from. Each run writes to a
+// series of segment files named <dir>/<project>/<run>.<offset>.log, where
+// offset is the position of the segment's first byte in the run's output.
+// Once a segment reaches the segment size a new one is started and the
+// oldest segments beyond the configured count are deleted, so a run never
+// uses more than segmentSize*segments bytes while offsets stay stable for
+// readers.
+package logstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSegmentSize = 1 << 20  // bytes per segment file
+	DefaultSegments    = 8        // segments kept per run
+	DefaultTail        = 16 << 10 // bytes of recent output kept in memory
+)
+
+// Streams a line can come from.
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+	System = "system" // messages of pi-manager itself
+)
+
+// Line is one line of stored output.
+type Line struct {
+	Time   time.Time `json:"time"`
+	Step   string    `json:"step,omitempty"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
+
+// String renders a line as it appears in plain-text logs: output of a
+// step is labelled with the step's name.
+func (ln Line) String() string {
+	if ln.Step != "" && ln.Stream != System {
+		return "[" + ln.Step + "] " + ln.Text
+	}
+	return ln.Text
+}
+
+// ErrNotFound is returned when a run has no stored output.
+var ErrNotFound = errors.New("log not found")
+
+// Store manages the log files below a directory.
+type Store struct {
+	dir         string
+	segmentSize int64
+	segments    int
+	tail        int
+}
+
+// New returns a Store writing below dir with the default limits.
+func New(dir string) *Store {
+	return &Store{dir: dir, segmentSize: DefaultSegmentSize, segments: DefaultSegments, tail: DefaultTail}
+}
+
+// ErrInvalidProject is returned for project ids that do not name a
+// directory of their own below the store's.
+var ErrInvalidProject = errors.New("invalid project id")
+
+// projectDir returns the directory of a project's logs, which must be a
+// direct child of the store's directory: ids such as "..", "." or "a/b"
+// would have runs write into, prune or remove other directories.
+func (s *Store) projectDir(project string) (string, error) {
+	dir := filepath.Join(s.dir, project)
+	if strings.ContainsAny(project, `/\`) || filepath.Dir(dir) != filepath.Clean(s.dir) {
+		return "", ErrInvalidProject
+	}
+	return dir, nil
+}
+
+// Log is the output of a run being written. It is safe for concurrent use.
+type Log struct {
+	s       *Store
+	project string
+	dir     string
+	run     string
+	mu      sync.Mutex
+	f       *os.File
+	offset  int64 // bytes written so far
+	segment int64 // offset of the current segment
+	tail    []byte
+}
+
+// Create starts the log of a run. If the log file cannot be created the
+// error is returned together with a Log that only keeps the in-memory tail,
+// so callers can carry on without persisted output.
+func (s *Store) Create(project, run string) (*Log, error) {
+	l := &Log{s: s, project: project, run: run}
+	dir, err := s.projectDir(project)
+	if err != nil {
+		return l, err
+	}
+	if run == "" || strings.ContainsAny(run, `/\`) {
+		return l, fmt.Errorf("invalid run id %q", run)
+	}
+	l.dir = dir
+	if err := os.MkdirAll(l.dir, 0o755); err != nil {
+		return l, err
+	}
+	f, err := os.Create(l.segmentPath(0))
+	if err != nil {
+		return l, err
+	}
+	l.f = f
+	return l, nil
+}
+
+func (l *Log) segmentPath(offset int64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%s.%d.log", l.run, offset))
+}
+
+// Append stores lines of output.
+func (l *Log) Append(lines ...Line) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	for _, ln := range lines {
+		if ln.Time.IsZero() {
+			ln.Time = time.Now()
+		}
+		enc.Encode(ln)
+		l.tail = append(l.tail, ln.String()...)
+		l.tail = append(l.tail, '\n')
+	}
+	if len(l.tail) > 2*l.s.tail {
+		l.tail = append(l.tail[:0:0], l.tail[len(l.tail)-l.s.tail:]...)
+	}
+
+	// Write errors are not reported: the pipeline must not fail because its
+	// output could not be stored, and the tail is still kept.
+	if l.f != nil && l.offset-l.segment >= l.s.segmentSize {
+		l.rotate()
+	}
+	if l.f != nil {
+		l.f.Write(buf.Bytes())
+	}
+	l.offset += int64(buf.Len())
+}
+
+// System stores a message of pi-manager, one line per line of text.
+func (l *Log) System(step, text string) {
+	text = strings.TrimSuffix(text, "\n")
+	var lines []Line
+	now := time.Now()
+	for _, t := range strings.Split(text, "\n") {
+		lines = append(lines, Line{Time: now, Step: step, Stream: System, Text: t})
+	}
+	l.Append(lines...)
+}
+
+// LineWriter returns a writer storing what is written to it as lines of
+// the given step and stream. Flush stores a trailing partial line.
+func (l *Log) LineWriter(step, stream string) *LineWriter {
+	return &LineWriter{l: l, step: step, stream: stream}
+}
+
+// LineWriter splits output into lines. It is safe for concurrent use.
+type LineWriter struct {
+	l      *Log
+	step   string
+	stream string
+	mu     sync.Mutex
+	buf    []byte
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	var lines []Line
+	now := time.Now()
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, Line{Time: now, Step: w.step, Stream: w.stream, Text: strings.TrimSuffix(string(w.buf[:i]), "\r")})
+		w.buf = w.buf[i+1:]
+	}
+	if len(lines) > 0 {
+		w.l.Append(lines...)
+	}
+	return len(p), nil
+}
+
+// Flush stores a trailing partial line, if any.
+func (w *LineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.l.Append(Line{Step: w.step, Stream: w.stream, Text: string(w.buf)})
+		w.buf = nil
+	}
+}
+
+func (l *Log) rotate() error {
+	l.f.Close()
+	l.f = nil
+	f, err := os.Create(l.segmentPath(l.offset))
+	if err != nil {
+		return err
+	}
+	l.f = f
+	l.segment = l.offset
+	segs, err := segments(l.dir, l.run)
+	if err != nil {
+		return err
+	}
+	for len(segs) > l.s.segments {
+		os.Remove(segs[0].path)
+		segs = segs[1:]
+	}
+	return nil
+}
+
+// Tail returns the most recent output, starting at a line boundary when
+// older output had to be dropped.
+func (l *Log) Tail() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.tail
+	if len(t) > l.s.tail {
+		t = t[len(t)-l.s.tail:]
+		if i := strings.IndexByte(string(t), '\n'); i >= 0 {
+			t = t[i+1:]
+		}
+	}
+	return string(t)
+}
+
+// Close closes the current segment file and indexes the output for
+// searching.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	if err == nil {
+		err = l.s.WriteIndex(l.project, l.run)
+	}
+	return err
+}
+
+type segment struct {
+	offset int64
+	path   string
+}
+
+// segments lists a run's segment files, oldest first.
+func segments(dir, run string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []segment
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, run+".") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		off, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, run+"."), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, segment{offset: off, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].offset < out[j].offset })
+	return out, nil
+}
+
+// Chunk is a range of a run's output.
+type Chunk struct {
+	Run    string `json:"run"`
+	Offset int64  `json:"offset"`      // position of the first line in the stored output
+	Next   int64  `json:"next_offset"` // offset to continue reading from
+	Start  int64  `json:"start"`       // oldest offset still stored; earlier output was rotated away
+	Size   int64  `json:"size"`        // bytes stored so far
+	Lines  []Line `json:"lines"`
+}
+
+// Read returns whole lines of a run's output starting at offset, stopping
+// once about limit bytes of stored output have been read. A negative
+// offset reads the last limit bytes. Offsets are positions in the stored
+// form and should be treated as opaque cursors; one pointing into the
+// middle of a line moves to the next line, and one before the oldest
+// stored output moves forward to it.
+func (s *Store) Read(project, run string, offset, limit int64) (Chunk, error) {
+	dir, err := s.projectDir(project)
+	if err != nil {
+		return Chunk{}, ErrNotFound
+	}
+	segs, err := segments(dir, run)
+	if err != nil || len(segs) == 0 {
+		return Chunk{}, ErrNotFound
+	}
+	last := segs[len(segs)-1]
+	info, err := os.Stat(last.path)
+	if err != nil {
+		return Chunk{}, err
+	}
+	c := Chunk{Run: run, Start: segs[0].offset, Size: last.offset + info.Size(), Lines: []Line{}}
+	if offset < 0 {
+		offset = c.Size - limit
+	}
+	if offset < c.Start {
+		offset = c.Start
+	}
+	if offset > c.Size {
+		offset = c.Size
+	}
+
+	// start one byte early to tell whether offset is at the start of a line
+	pos := offset
+	if pos > c.Start {
+		pos--
+	}
+	rd, err := openAt(segs, pos, c.Size)
+	if err != nil {
+		return Chunk{}, err
+	}
+	defer rd.Close()
+	br := bufio.NewReader(rd)
+	if pos < offset {
+		skipped, err := br.ReadBytes('\n')
+		if err != nil {
+			c.Offset, c.Next = c.Size, c.Size
+			return c, nil
+		}
+		pos += int64(len(skipped))
+	}
+	c.Offset = pos
+	for pos-c.Offset < limit {
+		raw, err := br.ReadBytes('\n')
+		if err != nil {
+			break // end of output or a line still being written
+		}
+		pos += int64(len(raw))
+		var ln Line
+		if json.Unmarshal(raw, &ln) != nil {
+			ln = Line{Stream: System, Text: strings.TrimSuffix(string(raw), "\n")}
+		}
+		c.Lines = append(c.Lines, ln)
+	}
+	c.Next = pos
+	return c, nil
+}
+
+// openAt returns a reader over the stored output from pos up to size.
+func openAt(segs []segment, pos, size int64) (io.ReadCloser, error) {
+	var readers []io.Reader
+	var files multiCloser
+	for i, seg := range segs {
+		end := size
+		if i+1 < len(segs) {
+			end = segs[i+1].offset
+		}
+		if end <= pos {
+			continue
+		}
+		f, err := os.Open(seg.path)
+		if err != nil {
+			files.Close()
+			return nil, err
+		}
+		files = append(files, f)
+		start := seg.offset
+		if pos > start {
+			start = pos
+		}
+		readers = append(readers, io.NewSectionReader(f, start-seg.offset, end-start))
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(readers...), files}, nil
+}
+
+type multiCloser []*os.File
+
+func (m multiCloser) Close() error {
+	for _, f := range m {
+		f.Close()
+	}
+	return nil
+}
+
+// Prune deletes the logs of a project's runs other than those in keep.
+func (s *Store) Prune(project string, keep []string) {
+	wanted := map[string]bool{}
+	for _, id := range keep {
+		wanted[id] = true
+	}
+	dir, err := s.projectDir(project)
+	if err != nil {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		run, _, _ := strings.Cut(e.Name(), ".")
+		if !wanted[run] {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// RemoveProject deletes all logs of a project.
+func (s *Store) RemoveProject(project string) error {
+	dir, err := s.projectDir(project)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
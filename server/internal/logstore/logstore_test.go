@@ -0,0 +1,152 @@
+package logstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s := New(t.TempDir())
+	s.segmentSize, s.segments = 256, 3
+	return s
+}
+
+func writeLines(t *testing.T, s *Store, project, run string, n int) {
+	t.Helper()
+	l, err := s.Create(project, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := l.LineWriter("build", Stdout)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(w, "line %03d\n", i)
+	}
+	w.Flush()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteRotateRead(t *testing.T) {
+	s := newTestStore(t)
+	const n = 100
+	writeLines(t, s, "api", "r1", n)
+
+	segs, err := segments(filepath.Join(s.dir, "api"), "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != s.segments {
+		t.Fatalf("%d segments kept, want %d", len(segs), s.segments)
+	}
+
+	// page through everything still stored
+	var got []Line
+	c, err := s.Read("api", "r1", 0, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Start != segs[0].offset || c.Offset != c.Start {
+		t.Errorf("read from 0 starts at %d, want the oldest stored offset %d", c.Offset, segs[0].offset)
+	}
+	for {
+		got = append(got, c.Lines...)
+		if c.Next >= c.Size {
+			break
+		}
+		if c, err = s.Read("api", "r1", c.Next, 200); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) == 0 || len(got) >= n {
+		t.Fatalf("read %d lines, want some but not all of %d after rotation", len(got), n)
+	}
+	first := n - len(got)
+	for i, ln := range got {
+		if want := fmt.Sprintf("line %03d", first+i); ln.Text != want || ln.Step != "build" || ln.Stream != Stdout {
+			t.Fatalf("line %d = %+v, want %q from build/stdout", i, ln, want)
+		}
+	}
+
+	// an offset inside a line moves to the next one
+	mid, err := s.Read("api", "r1", c.Start+1, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mid.Lines) == 0 || mid.Lines[0].Text != got[1].Text {
+		t.Errorf("read from inside the first line starts with %+v, want %q", mid.Lines, got[1].Text)
+	}
+
+	// a negative offset reads the end
+	tail, err := s.Read("api", "r1", -1, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tail.Lines) == 0 || tail.Lines[len(tail.Lines)-1].Text != fmt.Sprintf("line %03d", n-1) || tail.Next != tail.Size {
+		t.Errorf("tail read = %+v, want it to end with the last line", tail)
+	}
+}
+
+func TestTail(t *testing.T) {
+	s := newTestStore(t)
+	s.tail = 32
+	l, err := s.Create("api", "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 20; i++ {
+		l.System("", fmt.Sprintf("message %02d", i))
+	}
+	if got, want := l.Tail(), "message 18\nmessage 19\n"; got != want {
+		t.Errorf("Tail() = %q, want %q", got, want)
+	}
+}
+
+func TestReadMissing(t *testing.T) {
+	s := newTestStore(t)
+	if _, err := s.Read("api", "nope", 0, 100); !errors.Is(err, ErrNotFound) {
+		t.Errorf("error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	s := newTestStore(t)
+	writeLines(t, s, "api", "r1", 3)
+	writeLines(t, s, "api", "r2", 3)
+	s.Prune("api", []string{"r2"})
+	if _, err := s.Read("api", "r1", 0, 100); !errors.Is(err, ErrNotFound) {
+		t.Errorf("pruned run: error = %v, want ErrNotFound", err)
+	}
+	if c, err := s.Read("api", "r2", 0, 1<<20); err != nil || len(c.Lines) != 3 {
+		t.Errorf("kept run: %d lines, error %v, want 3 lines", len(c.Lines), err)
+	}
+}
+
+func TestInvalidProject(t *testing.T) {
+	parent := t.TempDir()
+	s := New(filepath.Join(parent, "logs"))
+	marker := filepath.Join(parent, "keep")
+	if err := os.WriteFile(marker, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"", ".", "..", "a/b", `a\b`, "../logs2"} {
+		if _, err := s.Create(id, "r1"); !errors.Is(err, ErrInvalidProject) {
+			t.Errorf("Create(%q) error = %v, want ErrInvalidProject", id, err)
+		}
+		if err := s.RemoveProject(id); !errors.Is(err, ErrInvalidProject) {
+			t.Errorf("RemoveProject(%q) error = %v, want ErrInvalidProject", id, err)
+		}
+		s.Prune(id, nil)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("file next to the logs directory: %v", err)
+	}
+	if _, err := s.Create("api", "../r1"); err == nil {
+		t.Error("Create with a run id holding a separator succeeded")
+	}
+}
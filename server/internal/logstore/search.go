@@ -0,0 +1,205 @@
+package logstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Each finished run gets an index file <run>.idx: a bloom filter of the
+// lower-cased trigrams in its output. A search for a literal only reads
+// the runs whose filter contains every trigram of the literal.
+//
+// Layout: "PMIX1", the log size it covers (uint64), the number of filter
+// bits (uint32), then the filter itself.
+const (
+	indexMagic     = "PMIX1"
+	smallIndexBits = 1 << 16 // 8 KiB filter
+	largeIndexBits = 1 << 19 // 64 KiB filter for logs over 1 MiB
+)
+
+// Query selects lines in SearchRun.
+type Query struct {
+	Match   func(text string) bool
+	Literal string // text every match contains, used to skip runs via the index; may be empty
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// Hit is a matching line.
+type Hit struct {
+	Project string `json:"project"`
+	Run     string `json:"run"`
+	Offset  int64  `json:"offset"` // position of the line, usable as offset when reading the log
+	Line
+}
+
+// SearchRun returns the lines of a run matching q, oldest first. Finished
+// runs without an up-to-date index get one written while they are scanned.
+func (s *Store) SearchRun(project, run string, q Query, finished bool) ([]Hit, error) {
+	dir, err := s.projectDir(project)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	segs, err := segments(dir, run)
+	if err != nil || len(segs) == 0 {
+		return nil, ErrNotFound
+	}
+	last := segs[len(segs)-1]
+	info, err := os.Stat(last.path)
+	if err != nil {
+		return nil, err
+	}
+	size := last.offset + info.Size()
+	idxPath := filepath.Join(dir, run+".idx")
+
+	var build *bloom
+	if f, covered, err := readIndex(idxPath); err == nil && covered == size {
+		if !f.mayContain(q.Literal) {
+			return nil, nil
+		}
+	} else if finished {
+		build = newBloom(size)
+	}
+
+	rd, err := openAt(segs, segs[0].offset, size)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	br := bufio.NewReader(rd)
+	pos := segs[0].offset
+	var hits []Hit
+	for {
+		raw, err := br.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var ln Line
+		if json.Unmarshal(raw, &ln) != nil {
+			ln = Line{Stream: System, Text: strings.TrimSuffix(string(raw), "\n")}
+		}
+		if build != nil {
+			build.add(ln.Text)
+		}
+		if (q.Limit <= 0 || len(hits) < q.Limit) &&
+			(q.Since.IsZero() || !ln.Time.Before(q.Since)) &&
+			(q.Until.IsZero() || !ln.Time.After(q.Until)) &&
+			q.Match(ln.Text) {
+			hits = append(hits, Hit{Project: project, Run: run, Offset: pos, Line: ln})
+		} else if build == nil && q.Limit > 0 && len(hits) >= q.Limit {
+			break
+		}
+		pos += int64(len(raw))
+	}
+	if build != nil && pos == size {
+		build.write(idxPath, size)
+	}
+	return hits, nil
+}
+
+// WriteIndex indexes the complete output of a run.
+func (s *Store) WriteIndex(project, run string) error {
+	_, err := s.SearchRun(project, run, Query{Match: func(string) bool { return false }}, true)
+	return err
+}
+
+type bloom struct {
+	bits []byte
+}
+
+func newBloom(size int64) *bloom {
+	n := smallIndexBits
+	if size > 1<<20 {
+		n = largeIndexBits
+	}
+	return &bloom{bits: make([]byte, n/8)}
+}
+
+// trigrams calls fn with a hash of each lower-cased trigram of s.
+func trigrams(s string, fn func(h uint32)) {
+	b := []byte(strings.ToLower(s))
+	for i := 0; i+3 <= len(b); i++ {
+		// FNV-1a over the three bytes
+		h := uint32(2166136261)
+		for _, c := range b[i : i+3] {
+			h ^= uint32(c)
+			h *= 16777619
+		}
+		fn(h)
+	}
+}
+
+func (f *bloom) add(s string) {
+	n := uint32(len(f.bits) * 8)
+	trigrams(s, func(h uint32) {
+		bit := h % n
+		f.bits[bit/8] |= 1 << (bit % 8)
+	})
+}
+
+// mayContain reports whether text can occur in the indexed output.
+// Literals shorter than a trigram always may.
+func (f *bloom) mayContain(text string) bool {
+	n := uint32(len(f.bits) * 8)
+	ok := true
+	trigrams(text, func(h uint32) {
+		bit := h % n
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			ok = false
+		}
+	})
+	return ok
+}
+
+func (f *bloom) write(path string, covered int64) error {
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	var hdr [12]byte
+	binary.LittleEndian.PutUint64(hdr[:8], uint64(covered))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(f.bits)*8))
+	_, err = out.Write(append(append([]byte(indexMagic), hdr[:]...), f.bits...))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readIndex(path string) (*bloom, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	hdr := make([]byte, len(indexMagic)+12)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return nil, 0, err
+	}
+	if string(hdr[:len(indexMagic)]) != indexMagic {
+		return nil, 0, errors.New("not an index file")
+	}
+	covered := int64(binary.LittleEndian.Uint64(hdr[len(indexMagic):]))
+	n := binary.LittleEndian.Uint32(hdr[len(indexMagic)+8:])
+	if n == 0 || n%8 != 0 || n > largeIndexBits {
+		return nil, 0, errors.New("corrupt index file")
+	}
+	bits := make([]byte, n/8)
+	if _, err := io.ReadFull(f, bits); err != nil {
+		return nil, 0, err
+	}
+	return &bloom{bits: bits}, covered, nil
+}
@@ -0,0 +1,247 @@
+// Package projectfile reads and writes project definitions as YAML files,
+// one <id>.project.yaml per project, so projects can be kept in version
+// control.
+//
+// The keys are the ones the API uses for projects. Fields pi-manager
+// maintains itself, such as status and the last log, are not part of a
+// definition.
+package projectfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/davidrocha/pi-manager/internal/state"
+)
+
+// Suffix is the file name suffix of project definitions.
+const Suffix = ".project.yaml"
+
+// runtimeFields are maintained by pi-manager.
+var runtimeFields = map[string]bool{
+	"revision":           true,
+	"runtime_revision":   true,
+	"status":             true,
+	"last_log":           true,
+	"current_step":       true,
+	"progress":           true,
+	"next_run":           true,
+	"last_scheduled_run": true,
+	"source":             true,
+}
+
+// File is a project definition read from a directory.
+type File struct {
+	Path    string
+	ID      string // from the file name
+	Project state.Project
+	Err     error // why the file could not be used
+}
+
+// Decode parses a definition. The project id defaults to id and must match
+// it when given.
+func Decode(data []byte, id string) (state.Project, error) {
+	var p state.Project
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return p, err
+	}
+	for k := range raw {
+		if runtimeFields[k] {
+			return p, fmt.Errorf("%s is maintained by pi-manager and cannot be set", k)
+		}
+	}
+	// the API's JSON keys are reused, with scalars written where the
+	// project expects strings (ports: [8080]) accepted as such
+	j, err := json.Marshal(coerce(raw, reflect.TypeOf(p)))
+	if err != nil {
+		return p, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return p, errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if p.ID == "" {
+		p.ID = id
+	}
+	if p.ID != id {
+		return p, fmt.Errorf("id %q does not match the file name", p.ID)
+	}
+	return p, nil
+}
+
+// coerce converts YAML scalars to strings where t expects a string.
+func coerce(v interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		switch v.(type) {
+		case int, float64, bool:
+			return fmt.Sprint(v)
+		}
+	case reflect.Slice:
+		if list, ok := v.([]interface{}); ok {
+			for i := range list {
+				list[i] = coerce(list[i], t.Elem())
+			}
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for k := range m {
+				m[k] = coerce(m[k], t.Elem())
+			}
+		}
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.Anonymous {
+				// embedded fields are flattened into m
+				coerce(m, f.Type)
+				continue
+			}
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if val, ok := m[name]; ok {
+				m[name] = coerce(val, t.Field(i).Type)
+			}
+		}
+	}
+	return v
+}
+
+// Encode renders the definition of p.
+func Encode(p state.Project) ([]byte, error) {
+	j, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is YAML; parsing it into a node keeps the field order
+	var doc yaml.Node
+	if err := yaml.Unmarshal(j, &doc); err != nil {
+		return nil, err
+	}
+	m := doc.Content[0]
+	var kept []*yaml.Node
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		k, v := m.Content[i], m.Content[i+1]
+		if runtimeFields[k.Value] || isEmpty(v) {
+			continue
+		}
+		kept = append(kept, k, v)
+	}
+	m.Content = kept
+	blockStyle(&doc)
+	return yaml.Marshal(&doc)
+}
+
+func isEmpty(n *yaml.Node) bool {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return n.Tag == "!!null" || (n.Tag == "!!str" && n.Value == "")
+	case yaml.SequenceNode, yaml.MappingNode:
+		return len(n.Content) == 0
+	}
+	return false
+}
+
+// blockStyle drops the flow style JSON parses with, and writes multi-line
+// strings such as scripts as literal blocks.
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!str" && strings.Contains(n.Value, "\n") {
+		n.Style = yaml.LiteralStyle
+	}
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
+
+// Diff returns the definition keys whose values differ between a and b.
+func Diff(a, b state.Project) []string {
+	ma, mb := fields(a), fields(b)
+	var out []string
+	for k, va := range ma {
+		if vb, ok := mb[k]; !ok || !reflect.DeepEqual(va, vb) {
+			out = append(out, k)
+		}
+	}
+	for k := range mb {
+		if _, ok := ma[k]; !ok {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// fields returns the definition of p as a map, without empty values.
+func fields(p state.Project) map[string]interface{} {
+	data, _ := Encode(p)
+	var m map[string]interface{}
+	yaml.Unmarshal(data, &m)
+	return m
+}
+
+// LoadDir reads the definitions in dir, sorted by file name. A missing
+// directory holds no definitions.
+func LoadDir(dir string) ([]File, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var out []File
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), Suffix) {
+			continue
+		}
+		f := File{Path: filepath.Join(dir, e.Name()), ID: strings.TrimSuffix(e.Name(), Suffix)}
+		if err := state.ValidProjectID(f.ID); err != nil {
+			f.Err = fmt.Errorf("file name: %w", err)
+		} else if data, err := os.ReadFile(f.Path); err != nil {
+			f.Err = err
+		} else {
+			f.Project, f.Err = Decode(data, f.ID)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// Fingerprint summarizes the names, sizes and modification times of the
+// definitions in dir, to notice changes without reading every file.
+func Fingerprint(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return dir
+	}
+	h := sha256.New()
+	fmt.Fprintln(h, dir)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), Suffix) {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			fmt.Fprintln(h, e.Name(), info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
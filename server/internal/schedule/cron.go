@@ -0,0 +1,236 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule yields the activation times of a recurring job.
+type Schedule interface {
+	// Next returns the first activation time strictly after t.
+	Next(t time.Time) time.Time
+}
+
+// Interval fires every fixed duration, measured from the previous activation.
+type Interval time.Duration
+
+// Next returns t plus the interval, truncated to whole seconds.
+func (i Interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i)).Truncate(time.Second)
+}
+
+// After returns the first activation strictly after now in the series
+// through prev, the previous activation, so that a late check does not
+// shift later activations.
+func (i Interval) After(prev, now time.Time) time.Time {
+	if prev.After(now) {
+		return prev
+	}
+	d := time.Duration(i)
+	return prev.Add((now.Sub(prev)/d + 1) * d)
+}
+
+// Cron is a parsed five-field cron expression (minute hour dom month dow).
+type Cron struct {
+	minute, hour, dom, month, dow uint64 // bit sets of allowed values
+	domStar, dowStar              bool
+	loc                           *time.Location
+}
+
+type bounds struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteBounds = bounds{0, 59, nil}
+	hourBounds   = bounds{0, 23, nil}
+	domBounds    = bounds{1, 31, nil}
+	monthBounds  = bounds{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowBounds = bounds{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse compiles a schedule. It accepts standard five-field cron expressions,
+// the @daily style macros and "@every <duration>". An empty timezone means
+// the local zone of the daemon.
+func Parse(expr, timezone string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		return ParseInterval(strings.TrimSpace(expr[len("@every "):]))
+	}
+	loc := time.Local
+	if timezone != "" {
+		l, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown timezone %q", timezone)
+		}
+		loc = l
+	}
+	if m, ok := macros[strings.ToLower(expr)]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields in cron expression, got %d", len(fields))
+	}
+	c := &Cron{loc: loc}
+	var err error
+	if c.minute, err = parseField(fields[0], minuteBounds); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseField(fields[1], hourBounds); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseField(fields[2], domBounds); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseField(fields[3], monthBounds); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if c.dow, err = parseField(fields[4], dowBounds); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// 7 is an alias for Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*" || strings.HasPrefix(fields[2], "*/")
+	c.dowStar = fields[4] == "*" || strings.HasPrefix(fields[4], "*/")
+	return c, nil
+}
+
+// ParseInterval compiles a simple interval such as "30m" or "6h".
+func ParseInterval(s string) (Schedule, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval %q", s)
+	}
+	if d < time.Minute {
+		return nil, fmt.Errorf("interval %s is shorter than one minute", d)
+	}
+	return Interval(d), nil
+}
+
+func parseField(field string, b bounds) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := b.min, b.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			i := strings.Index(part, "-")
+			var err error
+			if lo, err = parseValue(part[:i], b); err != nil {
+				return 0, err
+			}
+			if hi, err = parseValue(part[i+1:], b); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			v, err := parseValue(part, b)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if step > 1 {
+				// "5/15" means starting at 5 every 15
+				hi = b.max
+			} else {
+				hi = v
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func parseValue(s string, b bounds) (int, error) {
+	if v, ok := b.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", v, b.min, b.max)
+	}
+	return v, nil
+}
+
+// Next returns the first minute after t matching the expression, evaluated in
+// the schedule's timezone. It gives up (returning the zero time) if nothing
+// matches within five years, which only happens for impossible dates such as
+// February 30th.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.In(c.loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+			if !next.After(t) {
+				// DST fall-back can map the next hour onto the current one
+				next = t.Add(time.Hour).Truncate(time.Hour)
+			}
+			t = next
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches applies the classic cron rule: when both day-of-month and
+// day-of-week are restricted, a day matching either one is accepted.
+func (c *Cron) dayMatches(t time.Time) bool {
+	domOK := c.dom&(1<<uint(t.Day())) != 0
+	dowOK := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
@@ -0,0 +1,151 @@
+package schedule
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	utc := func(y int, mo time.Month, d, h, mi int) time.Time {
+		return time.Date(y, mo, d, h, mi, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name, expr string
+		from, want time.Time
+	}{
+		{"every minute", "* * * * *", utc(2026, 1, 1, 10, 7), utc(2026, 1, 1, 10, 8)},
+		{"strictly after", "0 10 * * *", utc(2026, 1, 1, 10, 0), utc(2026, 1, 2, 10, 0)},
+		{"seconds dropped", "* * * * *", utc(2026, 1, 1, 10, 7).Add(30 * time.Second), utc(2026, 1, 1, 10, 8)},
+		{"fixed time", "30 9 * * *", utc(2026, 1, 1, 10, 0), utc(2026, 1, 2, 9, 30)},
+		{"step", "*/15 * * * *", utc(2026, 1, 1, 10, 7), utc(2026, 1, 1, 10, 15)},
+		{"step from a value", "5/20 * * * *", utc(2026, 1, 1, 10, 6), utc(2026, 1, 1, 10, 25)},
+		{"range with step", "0 8-12/2 * * *", utc(2026, 1, 1, 8, 30), utc(2026, 1, 1, 10, 0)},
+		{"list", "0 0 1,15 * *", utc(2026, 1, 2, 0, 0), utc(2026, 1, 15, 0, 0)},
+		{"next year", "0 0 1 1 *", utc(2026, 1, 2, 0, 0), utc(2027, 1, 1, 0, 0)},
+		{"names", "0 12 * jan-mar MON", utc(2026, 4, 1, 0, 0), utc(2027, 1, 4, 12, 0)},
+		{"sunday as 7", "0 0 * * 7", utc(2026, 1, 1, 0, 0), utc(2026, 1, 4, 0, 0)},
+		{"macro", "@monthly", utc(2026, 1, 15, 0, 0), utc(2026, 2, 1, 0, 0)},
+		{"leap day", "0 0 29 2 *", utc(2026, 3, 1, 0, 0), utc(2028, 2, 29, 0, 0)},
+		{"day of week only", "0 0 * * mon", utc(2026, 1, 1, 0, 0), utc(2026, 1, 5, 0, 0)},
+		// both restricted: either one matching is enough
+		{"dom or dow, dow matches", "0 0 13 * fri", utc(2026, 1, 1, 0, 0), utc(2026, 1, 2, 0, 0)},
+		{"dom or dow, dom matches", "0 0 13 * fri", utc(2026, 1, 10, 0, 0), utc(2026, 1, 13, 0, 0)},
+		// a stepped wildcard does not restrict, so both must match
+		{"stepped dom and dow", "0 0 */2 * mon", utc(2026, 1, 6, 0, 0), utc(2026, 1, 19, 0, 0)},
+		{"february 30th", "0 0 30 2 *", utc(2026, 1, 1, 0, 0), time.Time{}},
+		{"april 31st", "0 0 31 4 *", utc(2026, 1, 1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr, "UTC")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Lisbon")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(mo time.Month, d, h, mi int) time.Time {
+		return time.Date(2026, mo, d, h, mi, 0, 0, loc)
+	}
+	// clocks go from 01:00 to 02:00 on March 29th and from 02:00 back to
+	// 01:00 on October 25th
+	tests := []struct {
+		name, expr string
+		from       time.Time
+		want       []time.Time // in UTC
+	}{
+		{"hourly over the skipped hour", "0 * * * *", at(3, 29, 0, 10), []time.Time{
+			time.Date(2026, 3, 29, 1, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 29, 2, 0, 0, 0, time.UTC),
+		}},
+		{"time in the skipped hour", "30 1 * * *", at(3, 29, 0, 0), []time.Time{
+			time.Date(2026, 3, 30, 0, 30, 0, 0, time.UTC),
+		}},
+		{"hourly over the repeated hour", "0 * * * *", at(10, 25, 0, 10), []time.Time{
+			time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 10, 25, 1, 0, 0, 0, time.UTC),
+			time.Date(2026, 10, 25, 2, 0, 0, 0, time.UTC),
+		}},
+		{"time in the repeated hour", "30 1 * * *", at(10, 25, 0, 0), []time.Time{
+			time.Date(2026, 10, 25, 1, 30, 0, 0, time.UTC),
+			time.Date(2026, 10, 26, 1, 30, 0, 0, time.UTC),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse(tt.expr, "Europe/Lisbon")
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := tt.from
+			for i, want := range tt.want {
+				next = s.Next(next)
+				if !next.Equal(want) {
+					t.Fatalf("activation %d = %s, want %s", i, next.UTC(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr, tz string
+		want     string // in the error
+	}{
+		{"* * * *", "", "expected 5 fields"},
+		{"60 * * * *", "", "minute: value 60 out of range"},
+		{"* 24 * * *", "", "hour:"},
+		{"* * 0 * *", "", "day of month:"},
+		{"* * * 13 *", "", "month:"},
+		{"* * * * 8", "", "day of week:"},
+		{"5-1 * * * *", "", "invalid range"},
+		{"*/0 * * * *", "", "invalid step"},
+		{"* * * foo *", "", `invalid value "foo"`},
+		{"* * * * *", "Mars/Olympus", "unknown timezone"},
+		{"@every 10s", "", "shorter than one minute"},
+		{"@every soon", "", "invalid interval"},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.expr, tt.tz); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q, %q) error = %v, want one containing %q", tt.expr, tt.tz, err, tt.want)
+		}
+	}
+}
+
+func TestInterval(t *testing.T) {
+	s, err := Parse("@every 30m", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, ok := s.(Interval)
+	if !ok {
+		t.Fatalf("Parse returned %T, want Interval", s)
+	}
+	start := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	if got, want := i.Next(start.Add(1500*time.Millisecond)), start.Add(30*time.Minute+time.Second); !got.Equal(want) {
+		t.Errorf("Next = %s, want %s", got, want)
+	}
+	tests := []struct {
+		now, want time.Duration // after start
+	}{
+		{15 * time.Second, 30 * time.Minute},
+		{30 * time.Minute, 60 * time.Minute},
+		{95 * time.Minute, 120 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := i.After(start, start.Add(tt.now)); !got.Equal(start.Add(tt.want)) {
+			t.Errorf("After(start, start+%s) = start+%s, want start+%s", tt.now, got.Sub(start), tt.want)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package state
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Contents is what a store holds apart from the projects' runtime state and
+// the boot ID, which only mean something on the machine that recorded them.
+// It is what a backup saves.
+type Contents struct {
+	Projects  []ProjectConfig
+	Runs      map[string][]Run // per project, oldest first
+	Hooks     []Hook
+	Templates []Template
+	History   []PiHealthStats
+}
+
+// Contents returns a copy of the store's contents, sorted by id.
+func (s *Store) Contents() Contents {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c := Contents{
+		Projects:  make([]ProjectConfig, 0, len(s.configs)),
+		Runs:      make(map[string][]Run, len(s.runs)),
+		Hooks:     make([]Hook, 0, len(s.hooks)),
+		Templates: make([]Template, 0, len(s.templates)),
+		History:   append([]PiHealthStats{}, s.history...),
+	}
+	for _, p := range s.configs {
+		c.Projects = append(c.Projects, p)
+	}
+	for id, rs := range s.runs {
+		c.Runs[id] = append([]Run(nil), rs...)
+	}
+	for _, hk := range s.hooks {
+		c.Hooks = append(c.Hooks, hk)
+	}
+	for _, t := range s.templates {
+		c.Templates = append(c.Templates, t)
+	}
+	sort.Slice(c.Projects, func(i, j int) bool { return c.Projects[i].ID < c.Projects[j].ID })
+	sort.Slice(c.Hooks, func(i, j int) bool { return c.Hooks[i].ID < c.Hooks[j].ID })
+	sort.Slice(c.Templates, func(i, j int) bool { return c.Templates[i].ID < c.Templates[j].ID })
+	return c
+}
+
+// EncodeState writes c, apart from the history, in the format of the state
+// file.
+func EncodeState(c Contents) ([]byte, error) {
+	return json.MarshalIndent(snapshot{Version: SchemaVersion, Projects: c.Projects, Runs: c.Runs, Hooks: c.Hooks, Templates: c.Templates}, "", "  ")
+}
+
+// DecodeState reads what EncodeState wrote, or a state file, migrating
+// older versions like Load does. Runtime state in the data is ignored.
+func DecodeState(data []byte) (Contents, error) {
+	snap, _, err := decodeSnapshot(data)
+	if err != nil {
+		return Contents{}, err
+	}
+	return Contents{Projects: snap.Projects, Runs: snap.Runs, Hooks: snap.Hooks, Templates: snap.Templates}, nil
+}
+
+// Restore applies restored contents in a single change. The projects,
+// hooks and templates in c replace those with the same id; with replace
+// set, the ones missing from c are removed, projects with their runs.
+// A project whose configuration did not change keeps its revision; a
+// replaced one keeps its runtime state and the definition file managing
+// it, and a new one starts IDLE and unmanaged. Runs are merged by id and
+// health samples by time.
+func (s *Store) Restore(c Contents, replace bool) {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	restored := map[string]bool{}
+	for _, p := range c.Projects {
+		restored[p.ID] = true
+		cur, ok := s.configs[p.ID]
+		p.Source = cur.Source
+		p.Revision = cur.Revision
+		if !ok || !SameConfig(cur, p) {
+			p.Revision++
+		}
+		s.configs[p.ID] = p
+		if _, ok := s.runtime[p.ID]; !ok {
+			s.runtime[p.ID] = ProjectRuntime{Status: "IDLE"}
+		}
+	}
+	hooks := map[string]bool{}
+	for _, hk := range c.Hooks {
+		hooks[hk.ID] = true
+		s.hooks[hk.ID] = hk
+	}
+	templates := map[string]bool{}
+	for _, t := range c.Templates {
+		templates[t.ID] = true
+		s.templates[t.ID] = t
+	}
+	if replace {
+		for id := range s.configs {
+			if !restored[id] {
+				delete(s.configs, id)
+				delete(s.runtime, id)
+				delete(s.runs, id)
+			}
+		}
+		for id := range s.hooks {
+			if !hooks[id] {
+				delete(s.hooks, id)
+			}
+		}
+		for id := range s.templates {
+			if !templates[id] {
+				delete(s.templates, id)
+			}
+		}
+	}
+
+	for id, rs := range c.Runs {
+		if _, ok := s.configs[id]; ok {
+			s.runs[id] = mergeRuns(s.runs[id], rs)
+		}
+	}
+	s.history = mergeHistory(s.history, c.History, s.maxHist)
+
+	s.runtimeDirty = true
+	s.save(s.writeAll)
+}
+
+// SameConfig reports whether two configurations are equal apart from their
+// revision and source.
+func SameConfig(a, b ProjectConfig) bool {
+	a.Revision, a.Source = 0, ""
+	b.Revision, b.Source = 0, ""
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+// mergeRuns adds the runs of b missing from a, keeping the newest ones
+// within the retention limit.
+func mergeRuns(a, b []Run) []Run {
+	out := append([]Run(nil), a...)
+	seen := map[string]bool{}
+	for _, r := range a {
+		seen[r.ID] = true
+	}
+	for _, r := range b {
+		if !seen[r.ID] {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	if len(out) > maxRunsPerProject {
+		out = out[len(out)-maxRunsPerProject:]
+	}
+	return out
+}
+
+// mergeHistory adds the samples of b taken at times missing from a,
+// keeping the newest max.
+func mergeHistory(a, b []PiHealthStats, max int) []PiHealthStats {
+	out := append([]PiHealthStats{}, a...)
+	seen := map[int64]bool{}
+	for _, h := range a {
+		seen[h.Time.UnixNano()] = true
+	}
+	for _, h := range b {
+		if !seen[h.Time.UnixNano()] {
+			out = append(out, h)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	if len(out) > max {
+		out = out[len(out)-max:]
+	}
+	return out
+}
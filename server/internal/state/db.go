@@ -0,0 +1,452 @@
+package state
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the state database. Records are JSON encoded and keyed by id.
+var (
+	bucketMeta      = []byte("meta")      // version and boot_id
+	bucketProjects  = []byte("projects")  // ProjectConfig
+	bucketRuntime   = []byte("runtime")   // ProjectRuntime
+	bucketRuns      = []byte("runs")      // a project's runs, oldest first
+	bucketHooks     = []byte("hooks")     // Hook
+	bucketTemplates = []byte("templates") // Template
+	bucketHistory   = []byte("history")   // PiHealthStats by big-endian UnixNano
+)
+
+var buckets = [][]byte{bucketMeta, bucketProjects, bucketRuntime, bucketRuns, bucketHooks, bucketTemplates, bucketHistory}
+
+// errNoDatabase marks a database that was never filled, or whose import
+// did not complete.
+var errNoDatabase = errors.New("database not initialized")
+
+// NewDBStore creates a store kept in a bbolt database next to the snapshot
+// path, e.g. state.db for state.json. Changes are committed, and synced to
+// disk, as they happen; only the log tail of a running project waits for
+// the next Snapshot. Load imports the JSON state files into a new
+// database.
+func NewDBStore(path string) *Store {
+	s := NewStore(path)
+	s.dbPath = strings.TrimSuffix(path, filepath.Ext(path)) + ".db"
+	return s
+}
+
+// loadDB opens the database and reads it into memory. s.mu must be held.
+func (s *Store) loadDB() error {
+	fail := func(err error) error {
+		if s.db != nil {
+			s.db.Close()
+			s.db = nil
+		}
+		s.loadErr = err
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.dbPath), 0o755); err != nil {
+		return fail(err)
+	}
+	db, err := bolt.Open(s.dbPath, 0o600, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		err = errors.New("in use by another process")
+	}
+	if err != nil {
+		return fail(fmt.Errorf("%s: %w", s.dbPath, err))
+	}
+	s.db = db
+
+	err = db.View(s.readDB)
+	if errors.Is(err, errNoDatabase) {
+		err = s.importJSON()
+	}
+	if err != nil {
+		if s.loadErr != nil {
+			return fail(s.loadErr)
+		}
+		return fail(fmt.Errorf("%s: %w", s.dbPath, err))
+	}
+	s.dirty, s.runtimeDirty = false, false
+	return nil
+}
+
+// readDB replaces the store's contents with the database's.
+func (s *Store) readDB(tx *bolt.Tx) error {
+	meta := tx.Bucket(bucketMeta)
+	if meta == nil || meta.Get([]byte("version")) == nil {
+		return errNoDatabase
+	}
+	version, err := strconv.Atoi(string(meta.Get([]byte("version"))))
+	switch {
+	case err != nil:
+		return fmt.Errorf("corrupt: invalid version %q", meta.Get([]byte("version")))
+	case version > SchemaVersion:
+		return fmt.Errorf("%w (version %d, this build reads up to %d)", ErrNewerVersion, version, SchemaVersion)
+	case version < SchemaVersion:
+		// databases start at version 2; later formats add their
+		// migrations here
+		return fmt.Errorf("corrupt: unknown version %d", version)
+	}
+	s.bootID = string(meta.Get([]byte("boot_id")))
+
+	s.configs = map[string]ProjectConfig{}
+	s.runtime = map[string]ProjectRuntime{}
+	s.runs = map[string][]Run{}
+	s.hooks = map[string]Hook{}
+	s.templates = map[string]Template{}
+	s.history = []PiHealthStats{}
+	err = forEach(tx, bucketProjects, func(id string, data []byte) error {
+		var c ProjectConfig
+		err := decodeStrict(data, &c)
+		s.configs[id] = c
+		s.runtime[id] = ProjectRuntime{Status: "IDLE"}
+		return err
+	})
+	if err == nil {
+		err = forEach(tx, bucketRuntime, func(id string, data []byte) error {
+			var r ProjectRuntime
+			err := decodeStrict(data, &r)
+			if _, ok := s.configs[id]; ok {
+				s.runtime[id] = r
+			}
+			return err
+		})
+	}
+	if err == nil {
+		err = forEach(tx, bucketRuns, func(id string, data []byte) error {
+			var rs []Run
+			err := decodeStrict(data, &rs)
+			s.runs[id] = rs
+			return err
+		})
+	}
+	if err == nil {
+		err = forEach(tx, bucketHooks, func(id string, data []byte) error {
+			var hk Hook
+			err := decodeStrict(data, &hk)
+			s.hooks[id] = hk
+			return err
+		})
+	}
+	if err == nil {
+		err = forEach(tx, bucketTemplates, func(id string, data []byte) error {
+			var t Template
+			err := decodeStrict(data, &t)
+			s.templates[id] = t
+			return err
+		})
+	}
+	if err == nil {
+		err = forEach(tx, bucketHistory, func(_ string, data []byte) error {
+			var h PiHealthStats
+			err := decodeStrict(data, &h)
+			s.history = append(s.history, h)
+			return err
+		})
+	}
+	if len(s.history) > s.maxHist {
+		s.history = s.history[len(s.history)-s.maxHist:]
+	}
+	return err
+}
+
+// forEach calls fn for the records of a bucket, in key order. A record
+// that fails to decode is reported with its location.
+func forEach(tx *bolt.Tx, bucket []byte, fn func(key string, data []byte) error) error {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		if err := fn(string(k), v); err != nil {
+			if bytes.Equal(bucket, bucketHistory) && len(k) == 8 {
+				k = []byte(time.Unix(0, int64(binary.BigEndian.Uint64(k))).UTC().Format(time.RFC3339))
+			}
+			return fmt.Errorf("corrupt: %s/%s: %v", bucket, k, err)
+		}
+		return nil
+	})
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// importJSON fills a new database from the JSON state files, which are
+// then renamed to *.imported so they are neither imported again nor
+// mistaken for current state.
+func (s *Store) importJSON() error {
+	if s.path != s.dbPath {
+		if err := s.loadJSON(); err != nil {
+			return err
+		}
+	}
+	var b batch
+	if err := s.writeAll(&b); err != nil {
+		return err
+	}
+	if err := s.db.Update(b.apply); err != nil {
+		return err
+	}
+	for _, p := range []string{s.path, s.runtimePath(), s.historyPath()} {
+		if p == s.dbPath {
+			continue
+		}
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		if err := os.Rename(p, p+".imported"); err != nil {
+			log.Printf("state: %v", err)
+			continue
+		}
+		log.Printf("state: imported %s into %s", p, s.dbPath)
+	}
+	return nil
+}
+
+// writeAll replaces the database contents with the store's. s.mu must be
+// held.
+func (s *Store) writeAll(tx *batch) error {
+	for _, name := range buckets {
+		*tx = append(*tx, change{bucket: name, reset: true})
+	}
+	for id, c := range s.configs {
+		if err := putJSON(tx, bucketProjects, id, c); err != nil {
+			return err
+		}
+	}
+	if err := s.writeRuntime(tx); err != nil {
+		return err
+	}
+	for id, rs := range s.runs {
+		if err := putJSON(tx, bucketRuns, id, rs); err != nil {
+			return err
+		}
+	}
+	for id, hk := range s.hooks {
+		if err := putJSON(tx, bucketHooks, id, hk); err != nil {
+			return err
+		}
+	}
+	for id, t := range s.templates {
+		if err := putJSON(tx, bucketTemplates, id, t); err != nil {
+			return err
+		}
+	}
+	for _, h := range s.history {
+		if err := putJSON(tx, bucketHistory, string(historyKey(h.Time)), h); err != nil {
+			return err
+		}
+	}
+	put(tx, bucketMeta, "boot_id", []byte(s.bootID))
+	// written last: a database without a version is imported again
+	put(tx, bucketMeta, "version", []byte(strconv.Itoa(SchemaVersion)))
+	return nil
+}
+
+func (s *Store) writeRuntime(tx *batch) error {
+	for id, r := range s.runtime {
+		if err := putJSON(tx, bucketRuntime, id, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushDB writes the changes that were not written through: the runtime
+// state, or everything after a failed write.
+func (s *Store) flushDB() error {
+	return s.commitDB(true)
+}
+
+// commit writes the changes save queued. It is deferred by the methods
+// changing the store so that it runs once they released s.mu: readers are
+// not held up by the disk, and the changes are still committed before the
+// methods return.
+func (s *Store) commit() {
+	if err := s.commitDB(false); err != nil {
+		log.Printf("state: saving a change failed, retrying with the next snapshot: %v", err)
+	}
+}
+
+// commitDB commits the queued changes in one transaction, with flush also
+// the ones that were not written through. Commits are serialized by s.wmu,
+// taken before s.mu, so changes reach the database in the order they were
+// made in memory.
+func (s *Store) commitDB(flush bool) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	db, b := s.db, s.pending
+	s.pending = nil
+	var err error
+	if flush && db != nil {
+		switch {
+		case s.dirty:
+			// everything, the queued changes included
+			b = nil
+			err = s.writeAll(&b)
+		case s.runtimeDirty:
+			err = s.writeRuntime(&b)
+		}
+		s.dirty, s.runtimeDirty = false, false
+	}
+	s.mu.Unlock()
+	if db == nil {
+		return nil
+	}
+	if err == nil && len(b) > 0 {
+		err = db.Update(b.apply)
+	}
+	if err != nil {
+		s.markDirty(true, true)
+	}
+	return err
+}
+
+// save records a change to the projects, runs, hooks, templates or boot
+// ID. With a database fn queues it for the commit of the calling method;
+// otherwise it is written with the next snapshot. s.mu must be held.
+func (s *Store) save(fn func(tx *batch) error) {
+	if s.db == nil {
+		s.dirty = true
+		return
+	}
+	if err := fn(&s.pending); err != nil {
+		log.Printf("state: saving a change failed, retrying with the next snapshot: %v", err)
+		s.dirty = true
+	}
+}
+
+// saveRuntime records a change of a project's runtime state, queuing it for
+// the database if now is set. s.mu must be held.
+func (s *Store) saveRuntime(id string, r ProjectRuntime, now bool) {
+	if s.db == nil || !now {
+		s.runtimeDirty = true
+		return
+	}
+	if err := putJSON(&s.pending, bucketRuntime, id, r); err != nil {
+		log.Printf("state: saving a change failed, retrying with the next snapshot: %v", err)
+		s.runtimeDirty = true
+	}
+}
+
+// saveHistory writes a new health sample, if any, and deletes the dropped
+// oldest ones. The JSON backend writes the whole history with every
+// snapshot instead. s.mu must be held.
+func (s *Store) saveHistory(added *PiHealthStats, dropped []PiHealthStats) {
+	if s.db == nil {
+		return
+	}
+	s.save(func(tx *batch) error {
+		for _, h := range dropped {
+			*tx = append(*tx, change{bucket: bucketHistory, key: historyKey(h.Time), delete: true})
+		}
+		if added == nil {
+			return nil
+		}
+		return putJSON(tx, bucketHistory, string(historyKey(added.Time)), *added)
+	})
+}
+
+// batch is a list of changes to the database. It is filled while s.mu is
+// held, with the records already encoded, and applied once the lock is
+// released.
+type batch []change
+
+// change puts value under key in bucket, deletes the key, or with reset
+// replaces the bucket with an empty one.
+type change struct {
+	bucket, key, value []byte
+	delete, reset      bool
+}
+
+// apply makes the changes in tx.
+func (b batch) apply(tx *bolt.Tx) error {
+	for _, c := range b {
+		if c.reset {
+			if tx.Bucket(c.bucket) != nil {
+				if err := tx.DeleteBucket(c.bucket); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.CreateBucket(c.bucket); err != nil {
+				return err
+			}
+			continue
+		}
+		bk, err := tx.CreateBucketIfNotExists(c.bucket)
+		if err != nil {
+			return err
+		}
+		if c.delete {
+			err = bk.Delete(c.key)
+		} else {
+			err = bk.Put(c.key, c.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func put(tx *batch, bucket []byte, key string, value []byte) {
+	*tx = append(*tx, change{bucket: bucket, key: []byte(key), value: value})
+}
+
+func putJSON(tx *batch, bucket []byte, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	put(tx, bucket, key, data)
+	return nil
+}
+
+func deleteKey(tx *batch, bucket []byte, key string) error {
+	*tx = append(*tx, change{bucket: bucket, key: []byte(key), delete: true})
+	return nil
+}
+
+// historyKey orders health samples by time.
+func historyKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return k
+}
+
+// Close writes pending changes and closes the database, if the store has
+// one, and releases the lock on the JSON state files.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	db, loadErr, lock := s.db, s.loadErr, s.lock
+	s.lock = nil
+	s.mu.Unlock()
+	if lock != nil {
+		lock.Close()
+	}
+	if db == nil {
+		return nil
+	}
+	var err error
+	if loadErr == nil {
+		err = s.flushDB()
+	}
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package state
+
+import "sort"
+
+// Hook is an inbound webhook that triggers an action on a project when a
+// signed push event arrives.
+type Hook struct {
+	ID       string   `json:"id"`
+	Project  string   `json:"project"`
+	Action   string   `json:"action"`             // "start" or "deploy"
+	Secret   string   `json:"secret,omitempty"`   // HMAC key shared with the sender
+	Branches []string `json:"branches,omitempty"` // glob patterns on the pushed branch or tag; empty means the project branch
+}
+
+// AddHook registers or replaces a hook.
+func (s *Store) AddHook(hk Hook) {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks[hk.ID] = hk
+	s.save(func(tx *batch) error { return putJSON(tx, bucketHooks, hk.ID, hk) })
+}
+
+// RemoveHook deletes a hook by id.
+func (s *Store) RemoveHook(id string) {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.hooks, id)
+	s.save(func(tx *batch) error { return deleteKey(tx, bucketHooks, id) })
+}
+
+// GetHook returns a hook by id.
+func (s *Store) GetHook(id string) (Hook, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hk, ok := s.hooks[id]
+	return hk, ok
+}
+
+// GetHooks returns all hooks sorted by ID.
+func (s *Store) GetHooks() []Hook {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Hook, 0, len(s.hooks))
+	for _, hk := range s.hooks {
+		out = append(out, hk)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
@@ -0,0 +1,129 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SchemaVersion is the version of the state format this build writes.
+// State files without a version are version 1.
+const SchemaVersion = 2
+
+// migrations upgrade a decoded state file one version at a time:
+// migrations[v-1] turns version v into version v+1. They work on the
+// generic JSON document, so they do not depend on the current types.
+var migrations = []func(doc map[string]interface{}) error{
+	migrateSplitRuntime, // 1 → 2
+}
+
+// ErrNewerVersion is returned for state written by a newer pi-manager,
+// which this build must neither read nor overwrite.
+var ErrNewerVersion = errors.New("state was written by a newer version of pi-manager")
+
+// snapshot is the content of the state file.
+type snapshot struct {
+	Version   int                       `json:"version"`
+	Projects  []ProjectConfig           `json:"projects"`
+	Runtime   map[string]ProjectRuntime `json:"runtime,omitempty"` // only in migrated files, see migrateSplitRuntime
+	Runs      map[string][]Run          `json:"runs"`
+	BootID    string                    `json:"boot_id,omitempty"`
+	Hooks     []Hook                    `json:"hooks"`
+	Templates []Template                `json:"templates"`
+}
+
+// decodeSnapshot parses a state file, migrating it to SchemaVersion. It
+// returns the version the file was written in. Anything that does not
+// decode cleanly, including unknown keys, is an error rather than state
+// that is silently dropped.
+func decodeSnapshot(data []byte) (snapshot, int, error) {
+	var snap snapshot
+	var doc map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		if err == io.EOF {
+			return snap, 0, errors.New("corrupt: empty file")
+		}
+		return snap, 0, fmt.Errorf("corrupt: %w", err)
+	}
+	if dec.More() {
+		return snap, 0, errors.New("corrupt: data after the end of the state")
+	}
+	if doc == nil {
+		return snap, 0, errors.New("corrupt: not an object")
+	}
+
+	version := 1
+	if v, ok := doc["version"]; ok {
+		num, _ := v.(json.Number)
+		n, err := num.Int64()
+		if err != nil || n < 1 {
+			return snap, 0, fmt.Errorf("corrupt: invalid version %v", v)
+		}
+		version = int(n)
+	}
+	if version > SchemaVersion {
+		return snap, version, fmt.Errorf("%w (version %d, this build reads up to %d)", ErrNewerVersion, version, SchemaVersion)
+	}
+	for v := version; v < SchemaVersion; v++ {
+		if err := migrations[v-1](doc); err != nil {
+			return snap, version, fmt.Errorf("migrating from version %d: %w", v, err)
+		}
+	}
+	doc["version"] = SchemaVersion
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return snap, version, err
+	}
+	strict := json.NewDecoder(bytes.NewReader(migrated))
+	strict.DisallowUnknownFields()
+	if err := strict.Decode(&snap); err != nil {
+		return snap, version, fmt.Errorf("corrupt: %w", err)
+	}
+	return snap, version, nil
+}
+
+// runtimeKeys are the project fields moved into ProjectRuntime.
+var runtimeKeys = []string{"status", "last_log", "current_step", "progress", "next_run", "last_scheduled_run", "runtime_revision"}
+
+// migrateSplitRuntime moves the runtime fields projects carried into the
+// runtime section, which the runtime file overrides where it exists,
+// replaces the legacy single port with ports and starts revisions at 1.
+func migrateSplitRuntime(doc map[string]interface{}) error {
+	projects, _ := doc["projects"].([]interface{})
+	runtime := map[string]interface{}{}
+	for i, v := range projects {
+		p, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("project %d is not an object", i)
+		}
+		id, _ := p["id"].(string)
+		rt := map[string]interface{}{}
+		for _, k := range runtimeKeys {
+			if val, ok := p[k]; ok {
+				rt[k] = val
+				delete(p, k)
+			}
+		}
+		if len(rt) > 0 {
+			runtime[id] = rt
+		}
+		if port, ok := p["port"]; ok {
+			if ports, _ := p["ports"].([]interface{}); len(ports) == 0 && port != "" {
+				p["ports"] = []interface{}{port}
+			}
+			delete(p, "port")
+		}
+		if rev, ok := p["revision"]; !ok || rev == json.Number("0") {
+			p["revision"] = 1
+		}
+	}
+	if len(runtime) > 0 {
+		doc["runtime"] = runtime
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package state
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeSnapshotV1(t *testing.T) {
+	data := `{
+		"projects": [
+			{"id": "api", "path": "/srv/api", "port": "8080", "status": "ACTIVE", "last_log": "ok", "progress": 100},
+			{"id": "web", "ports": ["3000"], "port": "3001", "revision": 4}
+		],
+		"runs": {},
+		"hooks": [],
+		"templates": []
+	}`
+	snap, from, err := decodeSnapshot([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != 1 {
+		t.Errorf("version = %d, want 1", from)
+	}
+	if snap.Version != SchemaVersion {
+		t.Errorf("migrated version = %d, want %d", snap.Version, SchemaVersion)
+	}
+	if len(snap.Projects) != 2 {
+		t.Fatalf("got %d projects, want 2", len(snap.Projects))
+	}
+	api, web := snap.Projects[0], snap.Projects[1]
+	if len(api.Ports) != 1 || api.Ports[0] != "8080" {
+		t.Errorf("api ports = %v, want [8080]", api.Ports)
+	}
+	if len(web.Ports) != 1 || web.Ports[0] != "3000" {
+		t.Errorf("web ports = %v, want the ports it had, [3000]", web.Ports)
+	}
+	if api.Revision != 1 || web.Revision != 4 {
+		t.Errorf("revisions = %d, %d, want 1, 4", api.Revision, web.Revision)
+	}
+	rt, ok := snap.Runtime["api"]
+	if !ok || rt.Status != "ACTIVE" || rt.LastLog != "ok" || rt.Progress != 100 {
+		t.Errorf("api runtime = %+v, want the fields moved out of the project", rt)
+	}
+	if _, ok := snap.Runtime["web"]; ok {
+		t.Error("web has runtime state, want none")
+	}
+}
+
+func TestDecodeSnapshotCurrent(t *testing.T) {
+	data := `{"version": 2, "projects": [{"id": "api", "revision": 3}], "runs": {}, "hooks": [], "templates": []}`
+	snap, from, err := decodeSnapshot([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != SchemaVersion || len(snap.Projects) != 1 || snap.Projects[0].Revision != 3 {
+		t.Errorf("got version %d, projects %+v", from, snap.Projects)
+	}
+}
+
+func TestDecodeSnapshotErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string // in the error
+	}{
+		{"empty", ``, "empty file"},
+		{"not an object", `null`, "not an object"},
+		{"syntax", `{"version": 2,`, "corrupt"},
+		{"trailing data", `{"version": 2} {}`, "data after the end"},
+		{"invalid version", `{"version": "two"}`, "invalid version"},
+		{"zero version", `{"version": 0}`, "invalid version"},
+		{"unknown key", `{"version": 2, "projects": [], "extra": 1}`, `unknown field "extra"`},
+		{"unknown project key", `{"version": 2, "projects": [{"id": "a", "colour": "red"}]}`, `unknown field "colour"`},
+		{"legacy key in current version", `{"version": 2, "projects": [{"id": "a", "port": "80"}]}`, `unknown field "port"`},
+		{"project not an object", `{"projects": ["a"]}`, "project 0 is not an object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := decodeSnapshot([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeSnapshotNewer(t *testing.T) {
+	_, from, err := decodeSnapshot([]byte(`{"version": 99, "projects": [], "whatever": true}`))
+	if !errors.Is(err, ErrNewerVersion) {
+		t.Fatalf("error = %v, want ErrNewerVersion", err)
+	}
+	if from != 99 {
+		t.Errorf("version = %d, want 99", from)
+	}
+}
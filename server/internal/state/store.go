@@ -2,21 +2,49 @@ package state
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 // Store holds unit state in memory and persists snapshots.
 type Store struct {
-	mu       sync.RWMutex
-	projects map[string]Project
-	history  []PiHealthStats
-	path     string
-	stale    time.Time
+	mu        sync.RWMutex
+	configs   map[string]ProjectConfig
+	runtime   map[string]ProjectRuntime
+	runs      map[string][]Run // per project, oldest first
+	hooks     map[string]Hook
+	templates map[string]Template
+	bootID    string // kernel boot the snapshot was written under
+	history   []PiHealthStats
+	maxHist   int // health samples kept
+	path      string
+	stale     time.Time
+
+	// the snapshot and the runtime file are only rewritten when their
+	// contents changed
+	dirty        bool
+	runtimeDirty bool
+
+	loadErr error // why the state on disk could not be loaded; it is not overwritten
+
+	dbPath  string     // database the store is kept in, see NewDBStore
+	db      *bolt.DB   // open once loaded
+	pending batch      // changes to commit once s.mu is released, see save
+	wmu     sync.Mutex // serializes commits, see commitDB
+
+	lock *os.File // held while the JSON state files are in use, see Load
 }
 
 type PiHealthStats struct {
@@ -29,43 +57,121 @@ type PiHealthStats struct {
 
 // NewStore creates a store with snapshot path.
 func NewStore(path string) *Store {
-	return &Store{projects: map[string]Project{}, history: []PiHealthStats{}, path: path}
+	return &Store{configs: map[string]ProjectConfig{}, runtime: map[string]ProjectRuntime{}, runs: map[string][]Run{}, hooks: map[string]Hook{}, templates: map[string]Template{}, history: []PiHealthStats{}, maxHist: DefaultHistoryPoints, path: path, dirty: true, runtimeDirty: true}
 }
 
-// Load reads snapshot from disk if present.
+// Load reads snapshot from disk if present. A state file in an older format
+// is migrated, after saving a copy of it next to the original. A corrupt
+// state file, or one written by a newer version, is an error, after which
+// Snapshot refuses to overwrite it. Like the database, the JSON state files
+// are locked against other processes until Close.
 func (s *Store) Load() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.dbPath != "" {
+		return s.loadDB()
+	}
+	if err := s.lockJSON(); err != nil {
+		s.loadErr = err
+		return err
+	}
+	return s.loadJSON()
+}
+
+// lockJSON takes an exclusive lock on <state>.lock. s.mu must be held.
+func (s *Store) lockJSON() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			err = errors.New("in use by another process")
+		}
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.lock = f
+	return nil
+}
 
+// loadJSON reads the JSON state files. s.mu must be held.
+func (s *Store) loadJSON() error {
 	// Load projects
-	f, err := os.Open(s.path)
+	data, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.loadErr = err
+		return err
+	}
+	var snap snapshot
 	if err == nil {
-		defer f.Close()
-		dec := json.NewDecoder(f)
-		var snap struct {
-			Projects []Project `json:"projects"`
-		}
-		if err := dec.Decode(&snap); err == nil {
-			s.projects = map[string]Project{}
-			for _, p := range snap.Projects {
-				// Migration: if Ports is empty but legacy Port is set, migrate it
-				if len(p.Ports) == 0 && p.Port != "" {
-					p.Ports = []string{p.Port}
-					p.Port = ""
+		var from int
+		snap, from, err = decodeSnapshot(data)
+		if err != nil {
+			s.loadErr = fmt.Errorf("%s: %w", s.path, err)
+			return s.loadErr
+		}
+		s.dirty = false
+		if from < SchemaVersion {
+			bak := fmt.Sprintf("%s.v%d.bak", s.path, from)
+			if err := writeBackup(bak, data); err != nil {
+				s.loadErr = fmt.Errorf("backing up %s before migrating it: %w", s.path, err)
+				return s.loadErr
+			}
+			log.Printf("state: migrating %s from version %d to %d, original saved as %s", s.path, from, SchemaVersion, bak)
+			s.dirty = true
+		}
+	}
+	s.bootID = snap.BootID
+	s.runs = snap.Runs
+	if s.runs == nil {
+		s.runs = map[string][]Run{}
+	}
+	s.hooks = map[string]Hook{}
+	for _, hk := range snap.Hooks {
+		s.hooks[hk.ID] = hk
+	}
+	s.templates = map[string]Template{}
+	for _, t := range snap.Templates {
+		s.templates[t.ID] = t
+	}
+	s.configs = map[string]ProjectConfig{}
+	s.runtime = map[string]ProjectRuntime{}
+	for _, c := range snap.Projects {
+		s.configs[c.ID] = c
+		s.runtime[c.ID] = ProjectRuntime{Status: "IDLE"}
+		if r, ok := snap.Runtime[c.ID]; ok {
+			s.runtime[c.ID] = r
+		}
+	}
+
+	// Load runtime state from separate file; losing it only resets the
+	// projects' statuses
+	rdata, err := os.ReadFile(s.runtimePath())
+	if err == nil {
+		var rt map[string]ProjectRuntime
+		if err := json.Unmarshal(rdata, &rt); err != nil {
+			log.Printf("state: ignoring corrupt %s: %v", s.runtimePath(), err)
+		} else {
+			for id, r := range rt {
+				if _, ok := s.configs[id]; ok {
+					s.runtime[id] = r
 				}
-				s.projects[p.ID] = p
 			}
+			s.runtimeDirty = false
 		}
 	}
 
 	// Load history from separate file
-	histPath := s.historyPath()
-	hf, err := os.Open(histPath)
+	hdata, err := os.ReadFile(s.historyPath())
 	if err == nil {
-		defer hf.Close()
-		dec := json.NewDecoder(hf)
 		var hist []PiHealthStats
-		if err := dec.Decode(&hist); err == nil {
+		if err := json.Unmarshal(hdata, &hist); err != nil {
+			log.Printf("state: ignoring corrupt %s: %v", s.historyPath(), err)
+		} else {
 			s.history = hist
 		}
 	}
@@ -77,66 +183,146 @@ func (s *Store) Load() error {
 	return nil
 }
 
+// writeBackup saves data as path, keeping an existing backup: it is the
+// older of the two.
+func writeBackup(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// DataDir returns the directory holding the snapshot, under which run data
+// such as artifacts is kept.
+func (s *Store) DataDir() string {
+	return filepath.Dir(s.path)
+}
+
 func (s *Store) historyPath() string {
+	return s.sidePath("history")
+}
+
+func (s *Store) runtimePath() string {
+	return s.sidePath("runtime")
+}
+
+// sidePath names a file kept next to the snapshot, e.g. state-history.json.
+func (s *Store) sidePath(name string) string {
 	ext := filepath.Ext(s.path)
 	base := strings.TrimSuffix(s.path, ext)
-	return base + "-history" + ext
+	return base + "-" + name + ext
 }
 
-// Snapshot writes current units to disk atomically.
+// Snapshot writes current units to disk atomically. The snapshot holding
+// the project configurations, runs, hooks and templates, and the runtime
+// file holding the projects' runtime state, are only rewritten when they
+// changed since the last snapshot.
 func (s *Store) Snapshot() error {
+	s.mu.RLock()
+	db, loadErr := s.db, s.loadErr
+	s.mu.RUnlock()
+	if loadErr != nil {
+		return fmt.Errorf("not overwriting state that failed to load: %w", loadErr)
+	}
+	if db != nil {
+		return s.flushDB()
+	}
 	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
 		return err
 	}
 
 	// 1. Snapshot Projects
-	pf, err := os.CreateTemp(filepath.Dir(s.path), "state-*.tmp")
-	if err != nil {
-		return err
+	s.mu.Lock()
+	dirty, runtimeDirty := s.dirty, s.runtimeDirty
+	s.dirty, s.runtimeDirty = false, false
+	projects := make([]ProjectConfig, 0, len(s.configs))
+	for _, c := range s.configs {
+		projects = append(projects, c)
 	}
-	s.mu.RLock()
-	projects := make([]Project, 0, len(s.projects))
-	for _, p := range s.projects {
-		projects = append(projects, p)
+	runtime := make(map[string]ProjectRuntime, len(s.runtime))
+	for id, r := range s.runtime {
+		runtime[id] = r
 	}
-	s.mu.RUnlock()
+	runs := make(map[string][]Run, len(s.runs))
+	for id, rs := range s.runs {
+		runs[id] = append([]Run(nil), rs...)
+	}
+	hooks := make([]Hook, 0, len(s.hooks))
+	for _, hk := range s.hooks {
+		hooks = append(hooks, hk)
+	}
+	templates := make([]Template, 0, len(s.templates))
+	for _, t := range s.templates {
+		templates = append(templates, t)
+	}
+	bootID := s.bootID
+	history := s.history
+	s.mu.Unlock()
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].ID < hooks[j].ID })
+	sort.Slice(templates, func(i, j int) bool { return templates[i].ID < templates[j].ID })
 
 	// Sort projects by ID to maintain consistent order
 	sort.Slice(projects, func(i, j int) bool {
 		return projects[i].ID < projects[j].ID
 	})
 
-	enc := json.NewEncoder(pf)
-	enc.SetIndent("", "  ")
-	if err := enc.Encode(struct {
-		Projects []Project `json:"projects"`
-	}{Projects: projects}); err != nil {
-		pf.Close()
-		os.Remove(pf.Name())
-		return err
+	if dirty {
+		err := writeFile(s.path, "state-*.tmp", true, snapshot{Version: SchemaVersion, Projects: projects, Runs: runs, BootID: bootID, Hooks: hooks, Templates: templates})
+		if err != nil {
+			s.markDirty(true, false)
+			return err
+		}
 	}
-	pf.Close()
-	if err := os.Rename(pf.Name(), s.path); err != nil {
-		return err
+
+	// 2. Snapshot runtime state
+	if runtimeDirty {
+		if err := writeFile(s.runtimePath(), "runtime-*.tmp", true, runtime); err != nil {
+			s.markDirty(false, true)
+			return err
+		}
 	}
 
-	// 2. Snapshot History
-	hf, err := os.CreateTemp(filepath.Dir(s.path), "history-*.tmp")
+	// 3. Snapshot History
+	return writeFile(s.historyPath(), "history-*.tmp", false, history)
+}
+
+// markDirty flags the snapshot or the runtime file to be rewritten.
+func (s *Store) markDirty(config, runtime bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty = s.dirty || config
+	s.runtimeDirty = s.runtimeDirty || runtime
+}
+
+// writeFile atomically replaces path with v encoded as JSON.
+func writeFile(path, pattern string, indent bool, v interface{}) error {
+	f, err := os.CreateTemp(filepath.Dir(path), pattern)
 	if err != nil {
 		return err
 	}
-	s.mu.RLock()
-	history := s.history
-	s.mu.RUnlock()
-
-	encH := json.NewEncoder(hf)
-	if err := encH.Encode(history); err != nil {
-		hf.Close()
-		os.Remove(hf.Name())
+	enc := json.NewEncoder(f)
+	if indent {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(v); err != nil {
+		f.Close()
+		os.Remove(f.Name())
 		return err
 	}
-	hf.Close()
-	return os.Rename(hf.Name(), s.historyPath())
+	f.Close()
+	return os.Rename(f.Name(), path)
 }
 
 // UpdateUnit updates or inserts a unit state.
@@ -144,52 +330,272 @@ func (s *Store) Snapshot() error {
 
 // PipelineStep represents a single command in a sequence.
 type PipelineStep struct {
-	Name string `json:"name"`
-	Cmd  string `json:"cmd"`
+	Name            string   `json:"name"`
+	Cmd             string   `json:"cmd"`
+	Timeout         string   `json:"timeout,omitempty"`           // per-attempt limit such as "10m"; none when empty
+	Retries         int      `json:"retries,omitempty"`           // extra attempts after a failure
+	Backoff         string   `json:"backoff,omitempty"`           // delay before the first retry, doubled each time (default 5s)
+	ContinueOnError bool     `json:"continue_on_error,omitempty"` // a failure is logged but does not fail the pipeline
+	WorkingDir      string   `json:"working_dir,omitempty"`       // relative to the project path, or absolute
+	When            string   `json:"when,omitempty"`              // success (default), failure, always, changed:<glob>, exists:<path>
+	Needs           []string `json:"needs,omitempty"`             // steps that must finish first; enables parallel execution
 }
 
-// Project represents a custom project configuration to manage via the UI/API.
+// Project is a project as the API presents it: its configuration together
+// with its runtime state. The two are stored, versioned and updated
+// separately, so editing a project never clobbers the status of a running
+// pipeline and pipeline progress never rewrites the configuration.
 type Project struct {
-	ID          string         `json:"id"`
-	Description string         `json:"description"`
-	CheckCmd    string         `json:"check_cmd"`      // command to check status
-	Pipeline    []PipelineStep `json:"pipeline"`       // sequence of commands to run
-	Path        string         `json:"path,omitempty"` // optional path to the application
-	Status      string         `json:"status"`         // IDLE, RUNNING, FAILED
-	LastLog     string         `json:"last_log"`       // output of the last execution
-	CurrentStep string         `json:"current_step"`   // name of the currently running step
-	Progress    int            `json:"progress"`       // progress percentage 0-100
-	Ports       []string       `json:"ports"`          // optional port numbers
-	Port        string         `json:"port,omitempty"` // legacy field for migration
-}
-
-// projects map stores configured projects
-// add to Store struct via embedding a field (but file-level change easier)
-
-// AddProject registers a project in the store.
-func (s *Store) AddProject(p Project) {
+	ProjectConfig
+	ProjectRuntime
+}
+
+// AllPorts returns the configured ports followed by the other ones found
+// listening.
+func (p Project) AllPorts() []string {
+	out := append([]string(nil), p.Ports...)
+	for _, port := range p.ListeningPorts {
+		found := false
+		for _, q := range p.Ports {
+			if q == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, port)
+		}
+	}
+	return out
+}
+
+// ProjectConfig is a project's configuration, set through the API or a
+// definition file.
+type ProjectConfig struct {
+	ID             string            `json:"id"`
+	Revision       int64             `json:"revision"` // incremented by every configuration change
+	Description    string            `json:"description"`
+	CheckCmd       string            `json:"check_cmd"`                 // command to check status
+	Pipeline       []PipelineStep    `json:"pipeline"`                  // sequence of commands to run; overrides template steps by name
+	Template       string            `json:"template,omitempty"`        // optional pipeline template ID
+	TemplateParams map[string]string `json:"template_params,omitempty"` // values for the template's parameters
+	MaxParallel    int               `json:"max_parallel,omitempty"`    // concurrent steps when steps declare needs (default 2)
+	Path           string            `json:"path,omitempty"`            // optional path to the application
+	Repo           string            `json:"repo,omitempty"`            // optional git remote Path is cloned from
+	Branch         string            `json:"branch,omitempty"`          // branch deployed when no ref is given
+	Ports          []string          `json:"ports"`                     // optional port numbers
+
+	DependsOn      []string      `json:"depends_on,omitempty"`      // projects started before this one
+	WaitHealthy    bool          `json:"wait_healthy,omitempty"`    // wait until dependencies are healthy before starting
+	HealthTimeout  string        `json:"health_timeout,omitempty"`  // how long to wait for dependencies (default 2m)
+	Group          string        `json:"group,omitempty"`           // stack the project is started and stopped with
+	StopCmd        string        `json:"stop_cmd,omitempty"`        // run before the project's processes are signalled
+	StopSignal     string        `json:"stop_signal,omitempty"`     // signal asking processes to exit (default SIGTERM)
+	StopTimeout    string        `json:"stop_timeout,omitempty"`    // grace period before SIGKILL (default 10s)
+	ReloadCmd      string        `json:"reload_cmd,omitempty"`      // run by the reload action instead of signalling
+	ReloadSignal   string        `json:"reload_signal,omitempty"`   // signal sent by the reload action (default SIGHUP)
+	Interactive    bool          `json:"interactive,omitempty"`     // steps get a stdin the web terminal can attach to
+	Autostart      bool          `json:"autostart,omitempty"`       // start when the daemon boots
+	AutostartDelay string        `json:"autostart_delay,omitempty"` // wait before starting it during boot, e.g. "10s"
+	Artifacts      *ArtifactSpec `json:"artifacts,omitempty"`       // files kept from successful runs
+	Schedule       *Schedule     `json:"schedule,omitempty"`        // optional recurring pipeline runs
+	Source         string        `json:"source,omitempty"`          // definition file the project is synced from, if any
+}
+
+// ProjectRuntime is the state pi-manager maintains for a project while
+// running it.
+type ProjectRuntime struct {
+	RuntimeRevision  int64      `json:"runtime_revision"`             // incremented by every runtime update
+	Status           string     `json:"status"`                       // IDLE, BOOTING, ACTIVE, FAILED
+	LastLog          string     `json:"last_log"`                     // output of the last execution
+	CurrentStep      string     `json:"current_step"`                 // name of the currently running step
+	Progress         int        `json:"progress"`                     // progress percentage 0-100
+	NextRun          *time.Time `json:"next_run,omitempty"`           // next scheduled run, maintained by the scheduler
+	LastScheduledRun *time.Time `json:"last_scheduled_run,omitempty"` // when the scheduler last fired
+	ListeningPorts   []string   `json:"listening_ports,omitempty"`    // ports found listening in the last run's process groups
+	ProcessGroups    []int      `json:"process_groups,omitempty"`     // process groups the project's steps started, to stop after a restart
+}
+
+// ArtifactSpec selects files kept from a successful run.
+type ArtifactSpec struct {
+	Paths   []string `json:"paths"`              // glob patterns relative to the project path; "dir/**" for a subtree
+	MaxSize int64    `json:"max_size,omitempty"` // byte cap per run (default 100 MiB)
+	Keep    int      `json:"keep,omitempty"`     // most recent runs whose artifacts are retained (default 5)
+}
+
+// Schedule describes when a project's pipeline should run on its own.
+// Exactly one of Cron or Every is expected to be set.
+type Schedule struct {
+	Cron     string `json:"cron,omitempty"`     // 5-field cron expression, @daily style macro or "@every 1h"
+	Every    string `json:"every,omitempty"`    // simple interval such as "6h"
+	Timezone string `json:"timezone,omitempty"` // IANA zone the cron expression is evaluated in (default: local)
+	Missed   string `json:"missed,omitempty"`   // "skip" (default) or "run": runs missed while the daemon was down
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// ValidProjectID checks a project id. Ids name the directories holding a
+// project's logs and artifacts, so "." and "..", path separators and
+// control characters are refused.
+func ValidProjectID(id string) error {
+	switch {
+	case id == "":
+		return errors.New("valid id required")
+	case id == "." || id == "..":
+		return fmt.Errorf("invalid id %q", id)
+	case strings.ContainsAny(id, `/\`):
+		return errors.New("id must not contain / or \\")
+	}
+	for _, c := range id {
+		if unicode.IsControl(c) {
+			return errors.New("id must not contain control characters")
+		}
+	}
+	return nil
+}
+
+// PutProjectConfig creates a project or replaces its configuration, and
+// returns the configuration stored. The revision is assigned by the store;
+// the runtime state of an existing project is left untouched, and a new
+// project starts IDLE.
+func (s *Store) PutProjectConfig(c ProjectConfig) ProjectConfig {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.Revision = s.configs[c.ID].Revision + 1
+	s.configs[c.ID] = c
+	r, ok := s.runtime[c.ID]
+	if !ok {
+		r = ProjectRuntime{Status: "IDLE"}
+		s.runtime[c.ID] = r
+		s.saveRuntime(c.ID, r, false)
+	}
+	s.save(func(tx *batch) error {
+		if err := putJSON(tx, bucketProjects, c.ID, c); err != nil {
+			return err
+		}
+		return putJSON(tx, bucketRuntime, c.ID, r)
+	})
+	return c
+}
+
+// ErrProjectNotFound is returned for updates of an unknown project.
+var ErrProjectNotFound = errors.New("project not found")
+
+// ErrRevisionMismatch is returned when a project's configuration changed
+// since the revision an update was based on.
+var ErrRevisionMismatch = errors.New("project was changed concurrently")
+
+// CreateProject adds a project with configuration c, starting IDLE. It
+// reports false if a project with the same id exists.
+func (s *Store) CreateProject(c ProjectConfig) (ProjectConfig, bool) {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.configs[c.ID]; ok {
+		return ProjectConfig{}, false
+	}
+	c.Revision = 1
+	r := ProjectRuntime{Status: "IDLE"}
+	s.configs[c.ID] = c
+	s.runtime[c.ID] = r
+	s.saveRuntime(c.ID, r, false)
+	s.save(func(tx *batch) error {
+		if err := putJSON(tx, bucketProjects, c.ID, c); err != nil {
+			return err
+		}
+		return putJSON(tx, bucketRuntime, c.ID, r)
+	})
+	return c, true
+}
+
+// ReplaceProjectConfig replaces the configuration of an existing project,
+// keeping its runtime state. With rev set, it fails with
+// ErrRevisionMismatch unless the stored revision is rev.
+func (s *Store) ReplaceProjectConfig(c ProjectConfig, rev int64) (ProjectConfig, error) {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, ok := s.configs[c.ID]
+	if !ok {
+		return ProjectConfig{}, ErrProjectNotFound
+	}
+	if rev != 0 && cur.Revision != rev {
+		return ProjectConfig{}, ErrRevisionMismatch
+	}
+	c.Revision = cur.Revision + 1
+	s.configs[c.ID] = c
+	s.save(func(tx *batch) error { return putJSON(tx, bucketProjects, c.ID, c) })
+	return c, nil
+}
+
+// UpdateProjectConfig applies fn to a project's configuration under the
+// store lock and increments its revision. It reports false if the project
+// does not exist.
+func (s *Store) UpdateProjectConfig(id string, fn func(c *ProjectConfig)) bool {
+	defer s.commit()
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.projects == nil {
-		s.projects = map[string]Project{}
+	c, ok := s.configs[id]
+	if !ok {
+		return false
 	}
-	s.projects[p.ID] = p
+	fn(&c)
+	c.ID = id
+	c.Revision = s.configs[id].Revision + 1
+	s.configs[id] = c
+	s.save(func(tx *batch) error { return putJSON(tx, bucketProjects, id, c) })
+	return true
 }
 
-// RemoveProject deletes a project by id.
+// UpdateRuntime applies fn to a project's runtime state under the store
+// lock and increments its runtime revision. It reports false if the project
+// does not exist.
+func (s *Store) UpdateRuntime(id string, fn func(r *ProjectRuntime)) bool {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.configs[id]; !ok {
+		return false
+	}
+	old := s.runtime[id]
+	r := old
+	fn(&r)
+	r.RuntimeRevision = old.RuntimeRevision + 1
+	s.runtime[id] = r
+	// the log tail changes with every line of output, so a change of only
+	// the log waits for the next snapshot
+	logOnly := r
+	logOnly.LastLog, logOnly.RuntimeRevision = old.LastLog, old.RuntimeRevision
+	s.saveRuntime(id, r, !reflect.DeepEqual(logOnly, old))
+	return true
+}
+
+// RemoveProject deletes a project and its run history by id.
 func (s *Store) RemoveProject(id string) {
+	defer s.commit()
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.projects, id)
+	delete(s.configs, id)
+	delete(s.runtime, id)
+	delete(s.runs, id)
+	s.runtimeDirty = true
+	s.save(func(tx *batch) error {
+		for _, b := range [][]byte{bucketProjects, bucketRuntime, bucketRuns} {
+			if err := deleteKey(tx, b, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // GetProjects returns all projects sorted by ID.
 func (s *Store) GetProjects() []Project {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	out := make([]Project, 0, len(s.projects))
-	for _, p := range s.projects {
-		out = append(out, p)
+	out := make([]Project, 0, len(s.configs))
+	for id, c := range s.configs {
+		out = append(out, Project{ProjectConfig: c, ProjectRuntime: s.runtime[id]})
 	}
 
 	// Sort projects by ID to maintain consistent order
@@ -204,18 +610,42 @@ func (s *Store) GetProjects() []Project {
 func (s *Store) GetProject(id string) (Project, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	p, ok := s.projects[id]
-	return p, ok
+	c, ok := s.configs[id]
+	if !ok {
+		return Project{}, false
+	}
+	return Project{ProjectConfig: c, ProjectRuntime: s.runtime[id]}, true
 }
 
 // AddPiHealthStat adds a health snapshot to history.
 func (s *Store) AddPiHealthStat(stat PiHealthStats) {
+	defer s.commit()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.history = append(s.history, stat)
-	// Keep last 43200 points (30 days if every 60s)
-	if len(s.history) > 43200 {
-		s.history = s.history[len(s.history)-43200:]
+	var dropped []PiHealthStats
+	if n := len(s.history) - s.maxHist; n > 0 {
+		dropped = s.history[:n]
+		s.history = s.history[n:]
+	}
+	s.saveHistory(&stat, dropped)
+}
+
+// DefaultHistoryPoints is the number of health samples kept by default, 30
+// days at one sample per minute.
+const DefaultHistoryPoints = 43200
+
+// SetHistoryLimit sets the number of health samples kept, dropping the
+// oldest ones beyond it.
+func (s *Store) SetHistoryLimit(n int) {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxHist = n
+	if len(s.history) > n {
+		dropped := s.history[:len(s.history)-n]
+		s.history = s.history[len(s.history)-n:]
+		s.saveHistory(nil, dropped)
 	}
 }
 
@@ -227,3 +657,101 @@ func (s *Store) GetPiHealthHistory() []PiHealthStats {
 	copy(out, s.history)
 	return out
 }
+
+// maxRunsPerProject bounds the run history kept for each project.
+const maxRunsPerProject = 50
+
+// Run records a single pipeline execution.
+type Run struct {
+	ID         string     `json:"id"`
+	Project    string     `json:"project"`
+	Trigger    string     `json:"trigger"`             // manual, schedule, deploy, ...
+	Ref        string     `json:"ref,omitempty"`       // ref requested for a deploy
+	Commit     string     `json:"commit,omitempty"`    // commit checked out when the pipeline ran
+	FromStep   string     `json:"from_step,omitempty"` // partial run resumed from this step
+	OnlyStep   string     `json:"only_step,omitempty"` // partial run of this single step
+	Status     string     `json:"status"`              // RUNNING, SUCCEEDED, FAILED, CANCELED
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Artifacts  []Artifact `json:"artifacts,omitempty"`
+}
+
+// Artifact is a file collected from a run.
+type Artifact struct {
+	Name   string `json:"name"` // path relative to the project path, slash separated
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// AddRun appends a run to its project's history, dropping the oldest runs
+// beyond the retention limit.
+func (s *Store) AddRun(r Run) {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs := append(s.runs[r.Project], r)
+	if len(rs) > maxRunsPerProject {
+		rs = rs[len(rs)-maxRunsPerProject:]
+	}
+	s.runs[r.Project] = rs
+	s.save(func(tx *batch) error { return putJSON(tx, bucketRuns, r.Project, rs) })
+}
+
+// UpdateRun applies fn to a stored run. It reports false if the run is gone.
+func (s *Store) UpdateRun(project, id string, fn func(r *Run)) bool {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs := s.runs[project]
+	for i := range rs {
+		if rs[i].ID == id {
+			fn(&rs[i])
+			s.save(func(tx *batch) error { return putJSON(tx, bucketRuns, project, rs) })
+			return true
+		}
+	}
+	return false
+}
+
+// BootID returns the kernel boot ID recorded with the loaded snapshot.
+func (s *Store) BootID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bootID
+}
+
+// SetBootID records the kernel boot ID saved with future snapshots.
+func (s *Store) SetBootID(id string) {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bootID = id
+	s.save(func(tx *batch) error {
+		put(tx, bucketMeta, "boot_id", []byte(id))
+		return nil
+	})
+}
+
+// GetRuns returns a project's runs, newest first.
+func (s *Store) GetRuns(project string) []Run {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rs := s.runs[project]
+	out := make([]Run, 0, len(rs))
+	for i := len(rs) - 1; i >= 0; i-- {
+		out = append(out, rs[i])
+	}
+	return out
+}
+
+// GetRun returns a single run of a project.
+func (s *Store) GetRun(project, id string) (Run, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, r := range s.runs[project] {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return Run{}, false
+}
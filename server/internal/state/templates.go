@@ -0,0 +1,52 @@
+package state
+
+import "sort"
+
+// Template is a reusable pipeline that projects reference by ID. Step fields
+// may use text/template placeholders such as {{.Branch}}, filled from the
+// template's parameter defaults, the project's template_params and the
+// project's own ID, Path, Repo, Branch and Port.
+type Template struct {
+	ID          string            `json:"id"`
+	Description string            `json:"description,omitempty"`
+	Params      map[string]string `json:"params,omitempty"` // parameter names and default values
+	Pipeline    []PipelineStep    `json:"pipeline"`
+}
+
+// AddTemplate registers or replaces a template.
+func (s *Store) AddTemplate(t Template) {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.templates[t.ID] = t
+	s.save(func(tx *batch) error { return putJSON(tx, bucketTemplates, t.ID, t) })
+}
+
+// RemoveTemplate deletes a template by id.
+func (s *Store) RemoveTemplate(id string) {
+	defer s.commit()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.templates, id)
+	s.save(func(tx *batch) error { return deleteKey(tx, bucketTemplates, id) })
+}
+
+// GetTemplate returns a template by id.
+func (s *Store) GetTemplate(id string) (Template, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.templates[id]
+	return t, ok
+}
+
+// GetTemplates returns all templates sorted by ID.
+func (s *Store) GetTemplates() []Template {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Template, 0, len(s.templates))
+	for _, t := range s.templates {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 
@@ -215,3 +216,45 @@ func (c *Client) JournalForUnit(unit string, lines int) ([]string, error) {
 	outLines := strings.Split(txt, "\n")
 	return outLines, nil
 }
+
+// JournalEntry is a message from the journal.
+type JournalEntry struct {
+	Time    time.Time `json:"time"`
+	Unit    string    `json:"unit"`
+	Message string    `json:"message"`
+}
+
+// JournalRange returns up to lines of the most recent journal entries for
+// unit written between since and until, oldest first. Zero times leave the
+// range open.
+func (c *Client) JournalRange(unit string, since, until time.Time, lines int) ([]JournalEntry, error) {
+	args := []string{"-u", unit, "-n", fmt.Sprint(lines), "--no-pager", "-o", "json"}
+	if !since.IsZero() {
+		args = append(args, "--since", fmt.Sprintf("@%d", since.Unix()))
+	}
+	if !until.IsZero() {
+		args = append(args, "--until", fmt.Sprintf("@%d", until.Unix()))
+	}
+	out, err := exec.Command("journalctl", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	var entries []JournalEntry
+	for _, line := range strings.Split(string(out), "\n") {
+		var raw struct {
+			Timestamp string      `json:"__REALTIME_TIMESTAMP"`
+			Message   interface{} `json:"MESSAGE"`
+		}
+		if json.Unmarshal([]byte(line), &raw) != nil {
+			continue
+		}
+		msg, ok := raw.Message.(string)
+		if !ok {
+			// binary messages are exported as byte arrays; skip them
+			continue
+		}
+		usec, _ := strconv.ParseInt(raw.Timestamp, 10, 64)
+		entries = append(entries, JournalEntry{Time: time.UnixMicro(usec), Unit: unit, Message: msg})
+	}
+	return entries, nil
+}